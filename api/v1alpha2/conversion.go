@@ -0,0 +1,229 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+// hubStatusAnnotationKey is the annotation keeping, on the v1alpha2 version
+// of an issuer, the status fields v1alpha2 does not define, so that
+// converting the issuer back to v1beta1 loses none of them.
+const hubStatusAnnotationKey = "puppetca.camptocamp.com/v1beta1-status"
+
+// hubStatus holds the fields of a v1beta1 status that v1alpha2 does not
+// define. All the conditions are kept, as v1alpha2 conditions have no
+// observed generation.
+type hubStatus struct {
+	Conditions         []metav1.Condition         `json:"conditions,omitempty"`
+	ObservedGeneration int64                      `json:"observedGeneration,omitempty"`
+	CA                 *v1beta1.CertificateStatus `json:"ca,omitempty"`
+	ClientCertificate  *v1beta1.CertificateStatus `json:"clientCertificate,omitempty"`
+	ServerVersion      string                     `json:"serverVersion,omitempty"`
+	LastContactTime    *metav1.Time               `json:"lastContactTime,omitempty"`
+}
+
+// ConvertTo converts this PuppetCAIssuer to the hub version.
+func (src *PuppetCAIssuer) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.PuppetCAIssuer)
+	dst.ObjectMeta = src.ObjectMeta
+	return convertTo(&src.Spec, &src.Status, &dst.ObjectMeta, &dst.Spec, &dst.Status)
+}
+
+// ConvertFrom converts from the hub version to this PuppetCAIssuer.
+func (dst *PuppetCAIssuer) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.PuppetCAIssuer)
+	dst.ObjectMeta = src.ObjectMeta
+	return convertFrom(&src.Spec, &src.Status, &dst.ObjectMeta, &dst.Spec, &dst.Status)
+}
+
+// ConvertTo converts this PuppetCAClusterIssuer to the hub version.
+func (src *PuppetCAClusterIssuer) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.PuppetCAClusterIssuer)
+	dst.ObjectMeta = src.ObjectMeta
+	return convertTo(&src.Spec, &src.Status, &dst.ObjectMeta, &dst.Spec, &dst.Status)
+}
+
+// ConvertFrom converts from the hub version to this PuppetCAClusterIssuer.
+func (dst *PuppetCAClusterIssuer) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.PuppetCAClusterIssuer)
+	dst.ObjectMeta = src.ObjectMeta
+	return convertFrom(&src.Spec, &src.Status, &dst.ObjectMeta, &dst.Spec, &dst.Status)
+}
+
+// convertTo converts a v1alpha2 spec and status to v1beta1, restoring the
+// fields kept in the hub status annotation of dstMeta, which is removed.
+// The v1alpha2 Ready condition replaces the kept one unless they are the
+// same. Conditions without a transition time are given the creation time of
+// the issuer, as metav1.Condition requires one.
+func convertTo(srcSpec *PuppetCAIssuerSpec, srcStatus *PuppetCAIssuerStatus,
+	dstMeta *metav1.ObjectMeta, dstSpec *v1beta1.PuppetCAIssuerSpec, dstStatus *v1beta1.PuppetCAIssuerStatus) error {
+
+	if err := convertJSON(srcSpec, dstSpec); err != nil {
+		return err
+	}
+
+	kept := hubStatus{}
+	if data, ok := dstMeta.Annotations[hubStatusAnnotationKey]; ok {
+		if err := json.Unmarshal([]byte(data), &kept); err != nil {
+			return err
+		}
+		dstMeta.Annotations = copyAnnotations(dstMeta.Annotations)
+		delete(dstMeta.Annotations, hubStatusAnnotationKey)
+		if len(dstMeta.Annotations) == 0 {
+			dstMeta.Annotations = nil
+		}
+	}
+	dstStatus.ObservedGeneration = kept.ObservedGeneration
+	dstStatus.CA = kept.CA
+	dstStatus.ClientCertificate = kept.ClientCertificate
+	dstStatus.ServerVersion = kept.ServerVersion
+	dstStatus.LastContactTime = kept.LastContactTime
+
+	converted := map[string]metav1.Condition{}
+	for _, c := range srcStatus.Conditions {
+		transition := dstMeta.CreationTimestamp
+		if c.LastTransitionTime != nil {
+			transition = *c.LastTransitionTime
+		}
+		reason := c.Reason
+		if reason == "" {
+			reason = "Unknown"
+		}
+		converted[string(c.Type)] = metav1.Condition{
+			Type:               string(c.Type),
+			Status:             metav1.ConditionStatus(c.Status),
+			ObservedGeneration: dstMeta.Generation,
+			LastTransitionTime: transition,
+			Reason:             reason,
+			Message:            c.Message,
+		}
+	}
+
+	dstStatus.Conditions = nil
+	for _, c := range kept.Conditions {
+		if cc, ok := converted[c.Type]; ok {
+			delete(converted, c.Type)
+			if !sameCondition(c, cc) {
+				c = cc
+			}
+		}
+		dstStatus.Conditions = append(dstStatus.Conditions, c)
+	}
+	for _, c := range srcStatus.Conditions {
+		if cc, ok := converted[string(c.Type)]; ok {
+			dstStatus.Conditions = append(dstStatus.Conditions, cc)
+		}
+	}
+	return convertStatus(srcStatus, dstStatus)
+}
+
+// convertFrom converts a v1beta1 spec and status to v1alpha2. Only the
+// Ready condition is converted, as v1alpha2 does not define the others; they
+// are kept along with the status fields added in v1beta1 in the hub status
+// annotation of dstMeta.
+func convertFrom(srcSpec *v1beta1.PuppetCAIssuerSpec, srcStatus *v1beta1.PuppetCAIssuerStatus,
+	dstMeta *metav1.ObjectMeta, dstSpec *PuppetCAIssuerSpec, dstStatus *PuppetCAIssuerStatus) error {
+
+	if err := convertJSON(srcSpec, dstSpec); err != nil {
+		return err
+	}
+
+	dstStatus.Conditions = nil
+	for _, c := range srcStatus.Conditions {
+		if c.Type != string(ConditionReady) {
+			continue
+		}
+		transition := c.LastTransitionTime
+		dstStatus.Conditions = append(dstStatus.Conditions, PuppetCAIssuerCondition{
+			Type:               ConditionReady,
+			Status:             ConditionStatus(c.Status),
+			LastTransitionTime: &transition,
+			Reason:             c.Reason,
+			Message:            c.Message,
+		})
+	}
+
+	kept := hubStatus{
+		Conditions:         srcStatus.Conditions,
+		ObservedGeneration: srcStatus.ObservedGeneration,
+		CA:                 srcStatus.CA,
+		ClientCertificate:  srcStatus.ClientCertificate,
+		ServerVersion:      srcStatus.ServerVersion,
+		LastContactTime:    srcStatus.LastContactTime,
+	}
+	dstMeta.Annotations = copyAnnotations(dstMeta.Annotations)
+	delete(dstMeta.Annotations, hubStatusAnnotationKey)
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	if string(data) != "{}" {
+		dstMeta.Annotations[hubStatusAnnotationKey] = string(data)
+	}
+	if len(dstMeta.Annotations) == 0 {
+		dstMeta.Annotations = nil
+	}
+	return convertStatus(srcStatus, dstStatus)
+}
+
+// sameCondition returns true if a and b only differ by their observed
+// generation, which v1alpha2 conditions do not have.
+func sameCondition(a, b metav1.Condition) bool {
+	return a.Type == b.Type && a.Status == b.Status && a.Reason == b.Reason &&
+		a.Message == b.Message && a.LastTransitionTime.Equal(&b.LastTransitionTime)
+}
+
+// copyAnnotations returns a copy of annotations, which the converted issuers
+// would otherwise share.
+func copyAnnotations(annotations map[string]string) map[string]string {
+	c := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		c[k] = v
+	}
+	return c
+}
+
+// convertStatus converts the fields of the statuses other than their
+// conditions, which are converted by the callers. Both versions share the
+// same fields, so they are converted through their JSON representation.
+func convertStatus(src, dst interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	delete(fields, "conditions")
+	return convertJSON(fields, dst)
+}
+
+// convertJSON converts src into dst through their JSON representation. It
+// is used for the specs, whose fields are the same in both versions.
+func convertJSON(src, dst interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
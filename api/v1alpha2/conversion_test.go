@@ -0,0 +1,224 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+var (
+	created    = metav1.Date(2020, 8, 31, 4, 30, 0, 0, time.UTC)
+	transition = metav1.Date(2020, 8, 31, 4, 34, 33, 0, time.UTC)
+)
+
+func hubIssuer(annotations map[string]string, status v1beta1.PuppetCAIssuerStatus) *v1beta1.PuppetCAIssuer {
+	return &v1beta1.PuppetCAIssuer{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "default",
+			Name:              "puppetca",
+			Generation:        2,
+			CreationTimestamp: created,
+			Annotations:       annotations,
+		},
+		Spec: v1beta1.PuppetCAIssuerSpec{
+			Provisioner: v1beta1.PuppetCAProvisioner{
+				Name: "puppetca",
+			},
+			SigningMode:              v1beta1.SigningModeManual,
+			ClientCertRenewalWarning: &metav1.Duration{Duration: time.Hour},
+		},
+		Status: status,
+	}
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	fullStatus := v1beta1.PuppetCAIssuerStatus{
+		Conditions: []metav1.Condition{
+			{
+				Type:               v1beta1.ConditionClientCertExpiring,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: 1,
+				LastTransitionTime: transition,
+				Reason:             "Valid",
+				Message:            "Client certificate is valid",
+			},
+			{
+				Type:               v1beta1.ConditionReady,
+				Status:             metav1.ConditionTrue,
+				ObservedGeneration: 2,
+				LastTransitionTime: transition,
+				Reason:             "Verified",
+				Message:            "PuppetCAIssuer verified",
+			},
+		},
+		ObservedGeneration: 2,
+		ActiveEndpoint:     "https://puppet:8140",
+		CA: &v1beta1.CertificateStatus{
+			Subject:     "CN=Puppet CA",
+			Fingerprint: "3C:A8",
+			NotAfter:    transition,
+		},
+		ClientCertificate: &v1beta1.CertificateStatus{
+			Subject:     "CN=puppetca-issuer",
+			Fingerprint: "9E:02",
+			NotAfter:    transition,
+		},
+		ServerVersion:   "6.14.1",
+		LastContactTime: &transition,
+	}
+
+	tests := []struct {
+		name string
+		hub  *v1beta1.PuppetCAIssuer
+	}{
+		{
+			name: "empty status",
+			hub:  hubIssuer(nil, v1beta1.PuppetCAIssuerStatus{}),
+		},
+		{
+			name: "full status",
+			hub:  hubIssuer(nil, fullStatus),
+		},
+		{
+			name: "other annotations",
+			hub:  hubIssuer(map[string]string{"foo": "bar"}, fullStatus),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := tt.hub.DeepCopy()
+
+			spoke := new(PuppetCAIssuer)
+			if err := spoke.ConvertFrom(tt.hub); err != nil {
+				t.Fatalf("ConvertFrom() error = %v", err)
+			}
+			if !equality.Semantic.DeepEqual(tt.hub, original) {
+				t.Fatalf("ConvertFrom() modified its source")
+			}
+
+			hub := new(v1beta1.PuppetCAIssuer)
+			if err := spoke.ConvertTo(hub); err != nil {
+				t.Fatalf("ConvertTo() error = %v", err)
+			}
+			if !equality.Semantic.DeepEqual(hub, original) {
+				t.Errorf("round trip = %+v, want %+v", hub, original)
+			}
+		})
+	}
+}
+
+func TestConvertToUpdatedReady(t *testing.T) {
+	hub := hubIssuer(nil, v1beta1.PuppetCAIssuerStatus{
+		Conditions: []metav1.Condition{{
+			Type:               v1beta1.ConditionReady,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: 1,
+			LastTransitionTime: transition,
+			Reason:             "Verified",
+		}},
+		ServerVersion: "6.14.1",
+	})
+
+	tests := []struct {
+		name      string
+		condition *PuppetCAIssuerCondition
+		want      metav1.Condition
+	}{
+		{
+			name: "unchanged",
+			want: hub.Status.Conditions[0],
+		},
+		{
+			name: "changed",
+			condition: &PuppetCAIssuerCondition{
+				Type:               ConditionReady,
+				Status:             ConditionFalse,
+				LastTransitionTime: &transition,
+				Reason:             "Unreachable",
+			},
+			want: metav1.Condition{
+				Type:               v1beta1.ConditionReady,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: 2,
+				LastTransitionTime: transition,
+				Reason:             "Unreachable",
+			},
+		},
+		{
+			name: "without transition time or reason",
+			condition: &PuppetCAIssuerCondition{
+				Type:   ConditionReady,
+				Status: ConditionFalse,
+			},
+			want: metav1.Condition{
+				Type:               v1beta1.ConditionReady,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: 2,
+				LastTransitionTime: created,
+				Reason:             "Unknown",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spoke := new(PuppetCAIssuer)
+			if err := spoke.ConvertFrom(hub); err != nil {
+				t.Fatalf("ConvertFrom() error = %v", err)
+			}
+			if tt.condition != nil {
+				spoke.Status.Conditions = []PuppetCAIssuerCondition{*tt.condition}
+			}
+
+			got := new(v1beta1.PuppetCAIssuer)
+			if err := spoke.ConvertTo(got); err != nil {
+				t.Fatalf("ConvertTo() error = %v", err)
+			}
+			if len(got.Status.Conditions) != 1 || !equality.Semantic.DeepEqual(got.Status.Conditions[0], tt.want) {
+				t.Errorf("conditions = %+v, want [%+v]", got.Status.Conditions, tt.want)
+			}
+			if got.Status.ServerVersion != "6.14.1" {
+				t.Errorf("serverVersion = %q, want 6.14.1", got.Status.ServerVersion)
+			}
+			if _, ok := got.Annotations[hubStatusAnnotationKey]; ok {
+				t.Errorf("annotation %s was not removed", hubStatusAnnotationKey)
+			}
+		})
+	}
+}
+
+func TestConvertClusterIssuerRoundTrip(t *testing.T) {
+	iss := hubIssuer(nil, v1beta1.PuppetCAIssuerStatus{ServerVersion: "6.14.1", ObservedGeneration: 2})
+	original := &v1beta1.PuppetCAClusterIssuer{ObjectMeta: iss.ObjectMeta, Spec: iss.Spec, Status: iss.Status}
+	original.Namespace = ""
+
+	spoke := new(PuppetCAClusterIssuer)
+	if err := spoke.ConvertFrom(original.DeepCopy()); err != nil {
+		t.Fatalf("ConvertFrom() error = %v", err)
+	}
+	hub := new(v1beta1.PuppetCAClusterIssuer)
+	if err := spoke.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo() error = %v", err)
+	}
+	if !equality.Semantic.DeepEqual(hub, original) {
+		t.Errorf("round trip = %+v, want %+v", hub, original)
+	}
+}
@@ -15,6 +15,9 @@ limitations under the License.
 */
 
 // Package v1alpha2 contains API Schema definitions for the certmanager v1alpha2 API group
+//
+// The certmanager.puppetca group is deprecated: its issuers are migrated by
+// the controller to the puppetca.camptocamp.com group, see package v1beta1.
 // +kubebuilder:object:generate=true
 // +groupName=certmanager.puppetca
 package v1alpha2
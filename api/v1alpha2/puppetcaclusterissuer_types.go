@@ -0,0 +1,48 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func init() {
+	SchemeBuilder.Register(&PuppetCAClusterIssuer{}, &PuppetCAClusterIssuerList{})
+}
+
+// +kubebuilder:object:root=true
+
+// PuppetCAClusterIssuer is the Schema for the puppetcaclusterissuers API.
+// Unlike PuppetCAIssuer, it is cluster scoped and can be referenced by
+// Certificates in any namespace.
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+type PuppetCAClusterIssuer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PuppetCAIssuerSpec   `json:"spec,omitempty"`
+	Status PuppetCAIssuerStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// PuppetCAClusterIssuerList contains a list of PuppetCAClusterIssuer
+type PuppetCAClusterIssuerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PuppetCAClusterIssuer `json:"items"`
+}
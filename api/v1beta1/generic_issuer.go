@@ -0,0 +1,64 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// PuppetCAIssuerKind is the kind of namespaced Puppet CA issuers.
+	PuppetCAIssuerKind = "PuppetCAIssuer"
+
+	// PuppetCAClusterIssuerKind is the kind of cluster scoped Puppet CA issuers.
+	PuppetCAClusterIssuerKind = "PuppetCAClusterIssuer"
+)
+
+// GenericIssuer is implemented by both PuppetCAIssuer and
+// PuppetCAClusterIssuer so that controllers can handle them alike.
+// +kubebuilder:object:generate=false
+type GenericIssuer interface {
+	runtime.Object
+	metav1.Object
+
+	GetObjectMeta() *metav1.ObjectMeta
+	GetSpec() *PuppetCAIssuerSpec
+	GetStatus() *PuppetCAIssuerStatus
+}
+
+var _ GenericIssuer = &PuppetCAIssuer{}
+var _ GenericIssuer = &PuppetCAClusterIssuer{}
+
+func (i *PuppetCAIssuer) GetObjectMeta() *metav1.ObjectMeta {
+	return &i.ObjectMeta
+}
+func (i *PuppetCAIssuer) GetSpec() *PuppetCAIssuerSpec {
+	return &i.Spec
+}
+func (i *PuppetCAIssuer) GetStatus() *PuppetCAIssuerStatus {
+	return &i.Status
+}
+
+func (i *PuppetCAClusterIssuer) GetObjectMeta() *metav1.ObjectMeta {
+	return &i.ObjectMeta
+}
+func (i *PuppetCAClusterIssuer) GetSpec() *PuppetCAIssuerSpec {
+	return &i.Spec
+}
+func (i *PuppetCAClusterIssuer) GetStatus() *PuppetCAIssuerStatus {
+	return &i.Status
+}
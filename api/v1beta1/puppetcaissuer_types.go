@@ -0,0 +1,467 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+func init() {
+	SchemeBuilder.Register(&PuppetCAIssuer{}, &PuppetCAIssuerList{})
+}
+
+// PuppetCAIssuerSpec defines the desired state of PuppetCAIssuer
+type PuppetCAIssuerSpec struct {
+	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// Provisioner contains the Puppet CA certificates provisioner configuration.
+	Provisioner PuppetCAProvisioner `json:"provisioner"`
+
+	// SigningMode defines how certificate requests are signed on the Puppet
+	// CA. With Auto, the default, the controller signs them itself. With
+	// Manual, it only submits them and waits for a Puppet administrator to
+	// sign them, e.g. with `puppetserver ca sign`.
+	// +optional
+	SigningMode SigningMode `json:"signingMode,omitempty"`
+
+	// RenewalPolicy defines what happens when a certificate already exists
+	// on the Puppet CA for the certname being requested, which is the case
+	// when a Certificate is renewed. With Replace, the default, the existing
+	// certificate is revoked and cleaned, provided that it was issued for the
+	// same Certificate. With Fail, the request fails.
+	// +optional
+	RenewalPolicy RenewalPolicy `json:"renewalPolicy,omitempty"`
+
+	// DeletionPolicy defines what happens on the Puppet CA when a
+	// Certificate is deleted. With Clean, the default, the certificate is
+	// revoked and removed from the Puppet CA. With Revoke, it is only
+	// revoked. With Retain, it is left untouched. It can be overridden per
+	// Certificate with the puppetca.camptocamp.com/deletion-policy annotation.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// CRL configures the periodic publication of the Puppet CA certificate
+	// revocation list into the cluster.
+	// +optional
+	CRL *CRLPublication `json:"crl,omitempty"`
+
+	// Timeouts bound the calls to the Puppet CA. Unset timeouts default to
+	// the ones configured on the controller command line.
+	// +optional
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+
+	// MaxRetryDuration is how long certificate requests failing with
+	// transient errors, such as network errors or 5xx answers of the Puppet
+	// CA, are retried with exponential backoff, counting from their
+	// creation. Once elapsed, they are marked as failed. By default, they
+	// are retried until they succeed.
+	// +optional
+	MaxRetryDuration *metav1.Duration `json:"maxRetryDuration,omitempty"`
+
+	// CertnameTemplate is a Go text/template rendering the Puppet certname
+	// of a certificate, e.g. k8s-{{.Namespace}}-{{.Name}}. It has access to
+	// the .Namespace and .Name of the Certificate, and to the .CommonName
+	// and first usable subject alternative name (.SAN) of the certificate.
+	// Defaults to the common name, or to the first usable SAN if there is no
+	// common name.
+	// +optional
+	CertnameTemplate string `json:"certnameTemplate,omitempty"`
+
+	// Policy restricts the names certificate requests may contain. Requests
+	// violating it are denied before reaching the Puppet CA.
+	// +optional
+	Policy *CertificatePolicy `json:"policy,omitempty"`
+
+	// TrustedFacts restricts the Puppet extensions certificate requests may
+	// carry, which Puppet turns into trusted facts. By default, the pp_auth_*
+	// authorization extensions are denied and all others are allowed.
+	// +optional
+	TrustedFacts *TrustedFactsPolicy `json:"trustedFacts,omitempty"`
+
+	// ClientCertRenewalWarning is how long before the expiration of the
+	// client certificate of the issuer the ClientCertExpiring condition is
+	// set, so that the certificate is renewed on the Puppet CA in time.
+	// Defaults to 30 days.
+	// +optional
+	ClientCertRenewalWarning *metav1.Duration `json:"clientCertRenewalWarning,omitempty"`
+}
+
+// DeletionPolicy defines how certificates are handled on the Puppet CA when
+// their Certificate is deleted.
+// +kubebuilder:validation:Enum=Clean;Revoke;Retain
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyClean revokes the certificate and removes it from the
+	// Puppet CA.
+	DeletionPolicyClean DeletionPolicy = "Clean"
+
+	// DeletionPolicyRevoke revokes the certificate.
+	DeletionPolicyRevoke DeletionPolicy = "Revoke"
+
+	// DeletionPolicyRetain leaves the certificate untouched.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+
+	// DeletionPolicyAnnotationKey is the Certificate annotation overriding
+	// the DeletionPolicy of the issuer.
+	DeletionPolicyAnnotationKey = "puppetca.camptocamp.com/deletion-policy"
+
+	// TrustedFactAnnotationPrefix prefixes the CertificateRequest
+	// annotations surfacing the Puppet extensions of the CSR, e.g.
+	// trusted-facts.puppetca.camptocamp.com/pp_role.
+	TrustedFactAnnotationPrefix = "trusted-facts.puppetca.camptocamp.com/"
+
+	// SubmittedAtAnnotationKey is the CertificateRequest annotation recording
+	// when its CSR was submitted to the Puppet CA for a manual signature.
+	SubmittedAtAnnotationKey = "puppetca.camptocamp.com/submitted-at"
+
+	// MigratedFromAnnotationKey is the annotation of the issuers migrated
+	// from the deprecated certmanager.puppetca API group, set to the
+	// group and version they were migrated from.
+	MigratedFromAnnotationKey = "puppetca.camptocamp.com/migrated-from"
+)
+
+// RenewalPolicy defines how existing certificates are handled on renewal.
+// +kubebuilder:validation:Enum=Replace;Fail
+type RenewalPolicy string
+
+const (
+	// RenewalPolicyReplace revokes and cleans the existing certificate.
+	RenewalPolicyReplace RenewalPolicy = "Replace"
+
+	// RenewalPolicyFail fails requests for certnames that already have a
+	// certificate.
+	RenewalPolicyFail RenewalPolicy = "Fail"
+)
+
+// SigningMode defines how certificate requests are signed on the Puppet CA.
+// +kubebuilder:validation:Enum=Auto;Manual
+type SigningMode string
+
+const (
+	// SigningModeAuto makes the controller sign the submitted requests.
+	SigningModeAuto SigningMode = "Auto"
+
+	// SigningModeManual leaves the submitted requests for a Puppet
+	// administrator to sign.
+	SigningModeManual SigningMode = "Manual"
+)
+
+// PuppetCAIssuerStatus defines the observed state of PuppetCAIssuer
+type PuppetCAIssuerStatus struct {
+	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// Conditions of the issuer. The Ready condition reports whether the
+	// issuer can sign certificates.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// ObservedGeneration is the generation of the issuer spec last
+	// reconciled.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// CRL reports the state of the CRL publication.
+	// +optional
+	CRL *CRLStatus `json:"crl,omitempty"`
+
+	// ActiveEndpoint is the URL of the Puppet CA endpoint currently in use.
+	// +optional
+	ActiveEndpoint string `json:"activeEndpoint,omitempty"`
+
+	// Endpoints reports the health of each Puppet CA endpoint.
+	// +optional
+	Endpoints []EndpointStatus `json:"endpoints,omitempty"`
+
+	// CA describes the certificate of the Puppet CA, as found in the CA
+	// bundle of the issuer.
+	// +optional
+	CA *CertificateStatus `json:"ca,omitempty"`
+
+	// ClientCertificate describes the certificate the issuer authenticates
+	// with on the Puppet CA.
+	// +optional
+	ClientCertificate *CertificateStatus `json:"clientCertificate,omitempty"`
+
+	// ServerVersion is the version of Puppet Server reported by the Puppet
+	// CA.
+	// +optional
+	ServerVersion string `json:"serverVersion,omitempty"`
+
+	// LastContactTime is the last time the Puppet CA answered.
+	// +optional
+	LastContactTime *metav1.Time `json:"lastContactTime,omitempty"`
+}
+
+// CertificateStatus describes a certificate used by the issuer.
+type CertificateStatus struct {
+	// Subject of the certificate.
+	Subject string `json:"subject"`
+
+	// Fingerprint is the SHA-256 fingerprint of the certificate, formatted
+	// as colon separated hexadecimal bytes like Puppet does.
+	Fingerprint string `json:"fingerprint"`
+
+	// NotAfter is the expiration time of the certificate.
+	NotAfter metav1.Time `json:"notAfter"`
+}
+
+// EndpointStatus reports the health of a Puppet CA endpoint.
+type EndpointStatus struct {
+	// URL of the endpoint.
+	URL string `json:"url"`
+
+	// Healthy is false if the endpoint failed repeatedly and is skipped
+	// until it is due to be tried again.
+	Healthy bool `json:"healthy"`
+
+	// ConsecutiveFailures is the number of failures since the endpoint last
+	// answered.
+	// +optional
+	ConsecutiveFailures int `json:"consecutiveFailures,omitempty"`
+
+	// LastError is the error of the last failure.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+
+	// LastFailureTime is the time of the last failure.
+	// +optional
+	LastFailureTime *metav1.Time `json:"lastFailureTime,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// PuppetCAIssuer is the Schema for the puppetcaissuers API
+// +kubebuilder:subresource:status
+// +kubebuilder:storageversion
+type PuppetCAIssuer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PuppetCAIssuerSpec   `json:"spec,omitempty"`
+	Status PuppetCAIssuerStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// PuppetCAIssuerList contains a list of PuppetCAIssuer
+type PuppetCAIssuerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PuppetCAIssuer `json:"items"`
+}
+
+// SecretKeySelector contains the reference to a key of a Secret or of a
+// ConfigMap, or to a file.
+type SecretKeySelector struct {
+	// Kind of the resource to select from, Secret, ConfigMap or File.
+	// Defaults to Secret.
+	// +optional
+	Kind CredentialSourceKind `json:"kind,omitempty"`
+
+	// Name of the resource to select from, in the namespace of the issuer.
+	// Defaults to the secretName of the provisioner for Secrets.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// The key of the secret to select from. Must be a valid secret key.
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// Path is the absolute path of the file to read in the controller pod,
+	// for the File kind.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// CredentialSourceKind is the kind of resource a credential is read from.
+// +kubebuilder:validation:Enum=Secret;ConfigMap;File
+type CredentialSourceKind string
+
+const (
+	// CredentialSourceSecret reads the credential from a Secret.
+	CredentialSourceSecret CredentialSourceKind = "Secret"
+
+	// CredentialSourceConfigMap reads the credential from a ConfigMap. It
+	// cannot be used for the private key.
+	CredentialSourceConfigMap CredentialSourceKind = "ConfigMap"
+
+	// CredentialSourceFile reads the credential from a file mounted in the
+	// controller pod, which is reloaded when it changes. It can only be
+	// used by PuppetCAClusterIssuers.
+	CredentialSourceFile CredentialSourceKind = "File"
+)
+
+// PuppetCAProvisioner contains the configuration for requesting certificate from the Puppet CA
+type PuppetCAProvisioner struct {
+	// The name of the secret in the pod's namespace to select from, unless
+	// a reference names another resource. Not required if every reference
+	// has a name.
+	// +optional
+	Name string `json:"secretName,omitempty"`
+
+	// Reference to URL of the Puppet CA. Defaults to the url key. Not
+	// required if Endpoints is set.
+	// +optional
+	URLRef SecretKeySelector `json:"url,omitempty"`
+
+	// Endpoints is an ordered list of URLs serving the same Puppet CA, such
+	// as a primary and a standby, overriding the URL from the secret.
+	// Requests are sent to the first healthy endpoint. An endpoint is
+	// considered unhealthy after repeated failures, and tried again later.
+	// +optional
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	// Reference to certificate to access the Puppet CA. Defaults to the
+	// cert key of the secretName Secret, or to the tls.crt key when the
+	// reference has a name.
+	// +optional
+	CertRef SecretKeySelector `json:"cert,omitempty"`
+
+	// Reference to the private key of the certificate to access the Puppet
+	// CA. Defaults to the key key of the secretName Secret, or to the
+	// tls.key key when the reference has a name. Must be a Secret.
+	// +optional
+	KeyRef SecretKeySelector `json:"key,omitempty"`
+
+	// Reference to the CA certificate of the Puppet CA. Defaults to the
+	// cacert key of the secretName Secret, or to the ca.crt key when the
+	// reference has a name. Not required if CABundle is set.
+	// +optional
+	CaCertRef SecretKeySelector `json:"cacert,omitempty"`
+
+	// CABundle is the PEM encoded CA certificate of the Puppet CA,
+	// overriding the one from the secret.
+	// +optional
+	CABundle string `json:"caBundle,omitempty"`
+}
+
+// Timeouts bound the calls to the Puppet CA.
+type Timeouts struct {
+	// Connect bounds the establishment of TCP connections. Defaults to 10s.
+	// +optional
+	Connect *metav1.Duration `json:"connect,omitempty"`
+
+	// TLSHandshake bounds TLS handshakes. Defaults to 10s.
+	// +optional
+	TLSHandshake *metav1.Duration `json:"tlsHandshake,omitempty"`
+
+	// Request bounds each request, from sending it to reading the whole
+	// response. Defaults to 30s.
+	// +optional
+	Request *metav1.Duration `json:"request,omitempty"`
+}
+
+// CRLPublication configures where the Puppet CA CRL is published.
+type CRLPublication struct {
+	// Kind of the object the CRL is published into, ConfigMap (the default)
+	// or Secret.
+	// +kubebuilder:validation:Enum=ConfigMap;Secret
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Name of the ConfigMap or Secret. It is created in the namespace of the
+	// issuer, or in the cluster resource namespace for cluster issuers.
+	Name string `json:"name"`
+
+	// Key under which the PEM encoded CRL is stored. Defaults to ca.crl.
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// RefreshInterval is the interval at which the CRL is fetched from the
+	// Puppet CA. Defaults to 1h.
+	// +optional
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+}
+
+// CRLStatus reports the state of the CRL publication.
+type CRLStatus struct {
+	// LastSyncTime is the time the CRL was last published.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// NextUpdate is the time by which the Puppet CA issues its next CRL, as
+	// stated in the published CRL.
+	// +optional
+	NextUpdate *metav1.Time `json:"nextUpdate,omitempty"`
+}
+
+// CertificatePolicy restricts the names of certificate requests. Each
+// NamePolicy applies to one kind of name of the CSR.
+type CertificatePolicy struct {
+	// CommonName restricts the common name of the subject.
+	// +optional
+	CommonName *NamePolicy `json:"commonName,omitempty"`
+
+	// DNSNames restricts the DNS subject alternative names.
+	// +optional
+	DNSNames *NamePolicy `json:"dnsNames,omitempty"`
+
+	// IPAddresses restricts the IP address subject alternative names.
+	// +optional
+	IPAddresses *NamePolicy `json:"ipAddresses,omitempty"`
+
+	// URIs restricts the URI subject alternative names.
+	// +optional
+	URIs *NamePolicy `json:"uris,omitempty"`
+}
+
+// NamePolicy lists the patterns names are matched against. A pattern is a
+// shell glob, such as *.example.com, or a regular expression enclosed in
+// slashes, such as /^web[0-9]+\.example\.com$/.
+type NamePolicy struct {
+	// Allowed patterns. If set, every name must match at least one of them.
+	// +optional
+	Allowed []string `json:"allowed,omitempty"`
+
+	// Denied patterns. Names matching any of them are denied, even if they
+	// are allowed.
+	// +optional
+	Denied []string `json:"denied,omitempty"`
+}
+
+// TrustedFactsPolicy restricts the Puppet extensions of certificate requests,
+// those under the 1.3.6.1.4.1.34380.1.1, .1.2 and .1.3 arcs. Extensions are
+// referred to by their short name, e.g. pp_role, or by their OID.
+type TrustedFactsPolicy struct {
+	// Allowed lists the extensions certificate requests may carry. If set,
+	// any other extension is denied. Authorization extensions, such as
+	// pp_auth_role, are only allowed if listed here.
+	// +optional
+	Allowed []string `json:"allowed,omitempty"`
+
+	// Required maps extensions certificate requests must carry to the value
+	// they must have. Required extensions are implicitly allowed.
+	// +optional
+	Required map[string]string `json:"required,omitempty"`
+}
+
+const (
+	// ConditionReady indicates that a PuppetCAIssuer is ready for use.
+	ConditionReady = "Ready"
+
+	// ConditionClientCertExpiring indicates that the client certificate of
+	// a PuppetCAIssuer expires within its ClientCertRenewalWarning, or has
+	// expired.
+	ConditionClientCertExpiring = "ClientCertExpiring"
+)
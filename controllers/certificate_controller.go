@@ -19,7 +19,8 @@ import (
 	"context"
 	"fmt"
 
-	api "github.com/camptocamp/puppetca-issuer/api/v1alpha2"
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	"github.com/camptocamp/puppetca-issuer/metrics"
 	"github.com/camptocamp/puppetca-issuer/provisioners"
 	"github.com/go-logr/logr"
 	apiutil "github.com/jetstack/cert-manager/pkg/api/util"
@@ -27,7 +28,7 @@ import (
 	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
 	core "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -38,6 +39,11 @@ type CertificateReconciler struct {
 	client.Client
 	Log      logr.Logger
 	Recorder record.EventRecorder
+	managerContext
+
+	// ClusterResourceNamespace is the namespace in which the certname
+	// ledgers of the issuers are stored.
+	ClusterResourceNamespace string
 }
 
 // +kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;update
@@ -46,7 +52,7 @@ type CertificateReconciler struct {
 // Reconcile will read and validate a Certificate resource
 // and manage the finalizer to delete it on the Puppet CA
 func (r *CertificateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	log := r.Log.WithValues("certificate", req.NamespacedName)
 
 	// Fetch the Certificate resource being reconciled.
@@ -63,11 +69,16 @@ func (r *CertificateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 
 	// Check the Certificate's issuerRef and if it does not match the api
 	// group name, log a message at a debug level and stop processing.
-	if crt.Spec.IssuerRef.Group != "" && crt.Spec.IssuerRef.Group != api.GroupVersion.Group {
+	if !isSupportedIssuerGroup(crt.Spec.IssuerRef.Group) {
 		log.V(4).Info("resource does not specify an issuerRef group name that we are responsible for", "group", crt.Spec.IssuerRef.Group)
 		return ctrl.Result{}, nil
 	}
 
+	if !isSupportedIssuerKind(crt.Spec.IssuerRef.Kind) {
+		log.V(4).Info("resource does not specify an issuerRef kind that we are responsible for", "kind", crt.Spec.IssuerRef.Kind)
+		return ctrl.Result{}, nil
+	}
+
 	// name of our custom finalizer
 	myFinalizerName := "puppetca.finalizers.cert-manager.io"
 
@@ -75,7 +86,7 @@ func (r *CertificateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		// Certificate is not being deleted
 		if !containsString(crt.ObjectMeta.Finalizers, myFinalizerName) {
 			crt.ObjectMeta.Finalizers = append(crt.ObjectMeta.Finalizers, myFinalizerName)
-			err := r.Update(context.Background(), crt)
+			err := r.Update(ctx, crt)
 			return ctrl.Result{}, err
 		}
 
@@ -91,53 +102,141 @@ func (r *CertificateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		return ctrl.Result{}, nil
 	}
 
-	// Fetch the PuppetCAIssuer resource
-	iss := api.PuppetCAIssuer{}
-	issNamespaceName := types.NamespacedName{
-		Namespace: crt.Namespace,
-		Name:      crt.Spec.IssuerRef.Name,
+	if err := r.release(ctx, log, crt); err != nil {
+		return ctrl.Result{}, err
 	}
-	if err := r.Client.Get(ctx, issNamespaceName, &iss); err != nil {
-		log.Error(err, "failed to retrieve PuppetCAIssuer resource", "namespace", crt.Namespace, "name", crt.Spec.IssuerRef.Name)
-		_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Pending", "Failed to retrieve PuppetCAIssuer resource %s: %v", issNamespaceName, err)
+
+	// Remove finalizer
+	crt.ObjectMeta.Finalizers = removeString(crt.ObjectMeta.Finalizers, myFinalizerName)
+	if err := r.Update(ctx, crt); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	// Check if the PuppetCAIssuer resource has been marked Ready
-	if !PuppetCAIssuerHasCondition(iss, api.PuppetCAIssuerCondition{Type: api.ConditionReady, Status: api.ConditionTrue}) {
+	return ctrl.Result{}, nil
+}
+
+// release applies the deletion policy of the Certificate, or else of its
+// issuer, to the certificate on the Puppet CA.
+func (r *CertificateReconciler) release(ctx context.Context, log logr.Logger, crt *cmapi.Certificate) error {
+	policy := api.DeletionPolicy(crt.Annotations[api.DeletionPolicyAnnotationKey])
+	switch policy {
+	case "", api.DeletionPolicyClean, api.DeletionPolicyRevoke:
+	case api.DeletionPolicyRetain:
+		// The issuer is not needed to leave the certificate untouched
+		log.Info("retaining certificate on the Puppet CA")
+		return nil
+	default:
+		err := fmt.Errorf("invalid %s annotation %q", api.DeletionPolicyAnnotationKey, policy)
+		log.Error(err, "failed to determine deletion policy")
+		_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Failed", "Failed to determine deletion policy: %v", err)
+		return err
+	}
+
+	// Fetch the PuppetCAIssuer or PuppetCAClusterIssuer resource
+	iss, issNamespaceName, err := getIssuer(ctx, r.Client, crt.Spec.IssuerRef, crt.Namespace)
+	if err != nil {
+		log.Error(err, "failed to retrieve issuer resource", "kind", crt.Spec.IssuerRef.Kind, "namespace", issNamespaceName.Namespace, "name", issNamespaceName.Name)
+		_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Pending", "Failed to retrieve %s resource %s: %v", crt.Spec.IssuerRef.Kind, issNamespaceName, err)
+		return err
+	}
+
+	if policy == "" {
+		policy = iss.GetSpec().DeletionPolicy
+	}
+	if policy == api.DeletionPolicyRetain {
+		log.Info("retaining certificate on the Puppet CA")
+		return nil
+	}
+
+	// Check if the issuer resource has been marked Ready
+	if !PuppetCAIssuerHasCondition(iss, meta.Condition{Type: api.ConditionReady, Status: meta.ConditionTrue}) {
 		err := fmt.Errorf("resource %s is not ready", issNamespaceName)
-		log.Error(err, "failed to retrieve PuppetCAIssuer resource", "namespace", crt.Namespace, "name", crt.Spec.IssuerRef.Name)
-		_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Pending", "PuppetCAIssuer resource %s is not Ready", issNamespaceName)
-		return ctrl.Result{}, err
+		log.Error(err, "failed to retrieve issuer resource", "kind", issuerKind(iss), "namespace", issNamespaceName.Namespace, "name", issNamespaceName.Name)
+		_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Pending", "%s resource %s is not Ready", issuerKind(iss), issNamespaceName)
+		return err
 	}
 
 	// Load the provisioner that will clean the Certificate
-	provisioner, ok := provisioners.Load(issNamespaceName)
+	provisioner, ok := provisioners.Load(issuerKey(iss))
 	if !ok {
 		err := fmt.Errorf("provisioner %s not found", issNamespaceName)
-		log.Error(err, "failed to provisioner for PuppetCAIssuer resource")
-		_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Pending", "Failed to load provisioner for PuppetCAIssuer resource %s", issNamespaceName)
-		return ctrl.Result{}, err
+		log.Error(err, "failed to provisioner for issuer resource", "kind", issuerKind(iss))
+		_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Pending", "Failed to load provisioner for %s resource %s", issuerKind(iss), issNamespaceName)
+		return err
 	}
 
-	// Clean Certificate
-	if err := provisioner.Clean(ctx, crt); err != nil {
-		log.Error(err, "failed to clean certificate")
-		return ctrl.Result{}, r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Failed", "Failed to clean certificate: %v", err)
+	// Only the certnames the ledger attributes to the Certificate are
+	// touched, whatever the current certname template of the issuer
+	ledger := newCertnameLedger(r.Client, iss, r.ClusterResourceNamespace)
+	certnames, err := ledger.Certnames(ctx, crt.UID)
+	if err != nil {
+		log.Error(err, "failed to read certname ledger")
+		_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Failed", "Failed to read certname ledger: %v", err)
+		return err
+	}
+	if len(certnames) == 0 {
+		log.Info("no certname recorded for the Certificate in the ledger, leaving the Puppet CA untouched")
+		return nil
 	}
 
-	// Remove finalizer
-	crt.ObjectMeta.Finalizers = removeString(crt.ObjectMeta.Finalizers, myFinalizerName)
-	if err := r.Update(context.Background(), crt); err != nil {
-		return ctrl.Result{}, err
+	key := issuerKey(iss)
+	owner := ledger.OwnerFunc(ctx, crt.UID)
+	for _, certname := range certnames {
+		if policy == api.DeletionPolicyRevoke {
+			// Revoke Certificate
+			err := provisioner.Revoke(ctx, certname, owner)
+			if provisioners.IsNotOwned(err) {
+				r.refuse(log, crt, err)
+				metrics.RecordFailure(key.Kind, key.NamespacedName, metrics.OperationRevoke, "NotOwned")
+				continue
+			}
+			if err != nil {
+				log.Error(err, "failed to revoke certificate", "certname", certname)
+				metrics.RecordFailure(key.Kind, key.NamespacedName, metrics.OperationRevoke, operationFailureReason(err))
+				_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Failed", "Failed to revoke certificate: %v", err)
+				return err
+			}
+			metrics.RecordSuccess(key.Kind, key.NamespacedName, metrics.OperationRevoke, "Revoked")
+			continue
+		}
+
+		// Clean Certificate
+		err := provisioner.Clean(ctx, certname, owner)
+		if provisioners.IsNotOwned(err) {
+			r.refuse(log, crt, err)
+			metrics.RecordFailure(key.Kind, key.NamespacedName, metrics.OperationClean, "NotOwned")
+			continue
+		}
+		if err != nil {
+			log.Error(err, "failed to clean certificate", "certname", certname)
+			metrics.RecordFailure(key.Kind, key.NamespacedName, metrics.OperationClean, operationFailureReason(err))
+			_ = r.setStatus(ctx, crt, cmmeta.ConditionFalse, "Failed", "Failed to clean certificate: %v", err)
+			return err
+		}
+		metrics.RecordSuccess(key.Kind, key.NamespacedName, metrics.OperationClean, "Cleaned")
+
+		// The certname is free again
+		if err := ledger.Forget(ctx, certname); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return ctrl.Result{}, nil
+// refuse reports that the certificate of crt was left untouched on the Puppet
+// CA because the ledger does not attribute it to crt. The finalizer is still
+// removed, as retrying would not change the outcome.
+func (r *CertificateReconciler) refuse(log logr.Logger, crt *cmapi.Certificate, err error) {
+	log.Info("leaving certificate untouched on the Puppet CA", "reason", err.Error())
+	r.Recorder.Eventf(crt, core.EventTypeWarning, "NotOwned", "Certificate left untouched on the Puppet CA: %v", err)
 }
 
 // SetupWithManager initializes the Certificate controller into the
 // controller runtime.
 func (r *CertificateReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := r.setupManagerContext(mgr); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&cmapi.Certificate{}).
 		Complete(r)
@@ -17,9 +17,13 @@ package controllers
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"time"
 
-	api "github.com/camptocamp/puppetca-issuer/api/v1alpha2"
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	"github.com/camptocamp/puppetca-issuer/metrics"
 	"github.com/camptocamp/puppetca-issuer/provisioners"
 	"github.com/go-logr/logr"
 	apiutil "github.com/jetstack/cert-manager/pkg/api/util"
@@ -27,27 +31,57 @@ import (
 	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
 	core "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// manualSigningPollInterval is the interval at which the Puppet CA is polled
+// for certificate requests awaiting a manual signature.
+const manualSigningPollInterval = 30 * time.Second
+
+// certificateRequestReasonDenied is the Ready condition reason of
+// CertificateRequests denied by the issuer policy. It is not defined by the
+// cert-manager version we build against.
+const certificateRequestReasonDenied = "Denied"
+
+// The conditions set by cert-manager approvers, from cert-manager 1.3
+// onwards. They are not defined by the cert-manager version we build
+// against.
+const (
+	certificateRequestConditionApproved cmapi.CertificateRequestConditionType = "Approved"
+	certificateRequestConditionDenied   cmapi.CertificateRequestConditionType = "Denied"
+)
+
 // CertificateRequestReconciler reconciles a PuppetCAIssuer object.
 type CertificateRequestReconciler struct {
 	client.Client
 	Log      logr.Logger
 	Recorder record.EventRecorder
+	managerContext
+
+	// ClusterResourceNamespace is the namespace in which the certname
+	// ledgers of the issuers are stored.
+	ClusterResourceNamespace string
+
+	// CheckApprovedCondition makes the reconciler wait for the Approved
+	// condition before signing a CertificateRequest, and fail it once it is
+	// Denied.
+	CheckApprovedCondition bool
 }
 
 // +kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests,verbs=get;list;watch;update
 // +kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update
 
 // Reconcile will read and validate a PuppetCAIssuer resource associated to the
 // CertificateRequest resource, and it will sign the CertificateRequest with the
 // provisioner in the PuppetCAIssuer.
 func (r *CertificateRequestReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	log := r.Log.WithValues("certificaterequest", req.NamespacedName)
 
 	// Fetch the CertificateRequest resource being reconciled.
@@ -64,11 +98,16 @@ func (r *CertificateRequestReconciler) Reconcile(req ctrl.Request) (ctrl.Result,
 
 	// Check the CertificateRequest's issuerRef and if it does not match the api
 	// group name, log a message at a debug level and stop processing.
-	if cr.Spec.IssuerRef.Group != "" && cr.Spec.IssuerRef.Group != api.GroupVersion.Group {
+	if !isSupportedIssuerGroup(cr.Spec.IssuerRef.Group) {
 		log.V(4).Info("resource does not specify an issuerRef group name that we are responsible for", "group", cr.Spec.IssuerRef.Group)
 		return ctrl.Result{}, nil
 	}
 
+	if !isSupportedIssuerKind(cr.Spec.IssuerRef.Kind) {
+		log.V(4).Info("resource does not specify an issuerRef kind that we are responsible for", "kind", cr.Spec.IssuerRef.Kind)
+		return ctrl.Result{}, nil
+	}
+
 	// If the certificate data is already set then we skip this request as it
 	// has already been completed in the past.
 	if len(cr.Status.Certificate) > 0 {
@@ -76,48 +115,116 @@ func (r *CertificateRequestReconciler) Reconcile(req ctrl.Request) (ctrl.Result,
 		return ctrl.Result{}, nil
 	}
 
+	// Requests that failed terminally, e.g. because they were denied, are
+	// never retried.
+	if cr.Status.FailureTime != nil {
+		log.V(4).Info("CertificateRequest has failed, skipping")
+		return ctrl.Result{}, nil
+	}
+
+	if r.CheckApprovedCondition {
+		if cond := apiutil.GetCertificateRequestCondition(cr, certificateRequestConditionDenied); cond != nil && cond.Status == cmmeta.ConditionTrue {
+			log.Info("CertificateRequest has been denied, marking as failed", "reason", cond.Reason)
+			failureTime := meta.Now()
+			cr.Status.FailureTime = &failureTime
+			return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonFailed,
+				"The CertificateRequest was denied by an approval controller: %s: %s", cond.Reason, cond.Message)
+		}
+
+		// The request is reconciled again when an approver sets the
+		// Approved condition
+		if cond := apiutil.GetCertificateRequestCondition(cr, certificateRequestConditionApproved); cond == nil || cond.Status != cmmeta.ConditionTrue {
+			log.V(4).Info("CertificateRequest has not been approved yet, skipping")
+			return ctrl.Result{}, nil
+		}
+	}
+
 	if cr.Spec.IsCA {
 		log.Info("PuppetCA certificate does not support online signing of CA certificates")
 		return ctrl.Result{}, nil
 	}
 
-	// Fetch the PuppetCAIssuer resource
-	iss := api.PuppetCAIssuer{}
-	issNamespaceName := types.NamespacedName{
-		Namespace: req.Namespace,
-		Name:      cr.Spec.IssuerRef.Name,
-	}
-	if err := r.Client.Get(ctx, issNamespaceName, &iss); err != nil {
-		log.Error(err, "failed to retrieve PuppetCAIssuer resource", "namespace", req.Namespace, "name", cr.Spec.IssuerRef.Name)
-		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending, "Failed to retrieve PuppetCAIssuer resource %s: %v", issNamespaceName, err)
+	// Fetch the PuppetCAIssuer or PuppetCAClusterIssuer resource
+	iss, issNamespaceName, err := getIssuer(ctx, r.Client, cr.Spec.IssuerRef, req.Namespace)
+	if err != nil {
+		log.Error(err, "failed to retrieve issuer resource", "kind", cr.Spec.IssuerRef.Kind, "namespace", issNamespaceName.Namespace, "name", issNamespaceName.Name)
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending, "Failed to retrieve %s resource %s: %v", cr.Spec.IssuerRef.Kind, issNamespaceName, err)
 		return ctrl.Result{}, err
 	}
 
-	// Check if the PuppetCAIssuer resource has been marked Ready
-	if !PuppetCAIssuerHasCondition(iss, api.PuppetCAIssuerCondition{Type: api.ConditionReady, Status: api.ConditionTrue}) {
+	// Check if the issuer resource has been marked Ready
+	if !PuppetCAIssuerHasCondition(iss, meta.Condition{Type: api.ConditionReady, Status: meta.ConditionTrue}) {
 		err := fmt.Errorf("resource %s is not ready", issNamespaceName)
-		log.Error(err, "failed to retrieve PuppetCAIssuer resource", "namespace", req.Namespace, "name", cr.Spec.IssuerRef.Name)
-		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending, "PuppetCAIssuer resource %s is not Ready", issNamespaceName)
+		log.Error(err, "failed to retrieve issuer resource", "kind", issuerKind(iss), "namespace", issNamespaceName.Namespace, "name", issNamespaceName.Name)
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending, "%s resource %s is not Ready", issuerKind(iss), issNamespaceName)
 		return ctrl.Result{}, err
 	}
 
 	// Load the provisioner that will sign the CertificateRequest
-	provisioner, ok := provisioners.Load(issNamespaceName)
+	provisioner, ok := provisioners.Load(issuerKey(iss))
 	if !ok {
 		err := fmt.Errorf("provisioner %s not found", issNamespaceName)
-		log.Error(err, "failed to provisioner for PuppetCAIssuer resource")
-		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending, "Failed to load provisioner for PuppetCAIssuer resource %s", issNamespaceName)
+		log.Error(err, "failed to provisioner for issuer resource", "kind", issuerKind(iss))
+		_ = r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending, "Failed to load provisioner for %s resource %s", issuerKind(iss), issNamespaceName)
 		return ctrl.Result{}, err
 	}
 
 	// Sign CertificateRequest
-	signedPEM, _, err := provisioner.Sign(ctx, cr)
+	key := issuerKey(iss)
+	ledger := newCertnameLedger(r.Client, iss, r.ClusterResourceNamespace)
+	crt, err := r.getCertificate(ctx, cr)
+	if err != nil {
+		log.Error(err, "failed to retrieve Certificate resource")
+		return ctrl.Result{}, err
+	}
+	if err := r.annotateTrustedFacts(ctx, cr); err != nil {
+		log.Error(err, "failed to annotate Puppet extensions")
+		return ctrl.Result{}, err
+	}
+	signedPEM, trustedCAs, err := provisioner.Sign(ctx, cr, iss.GetSpec(), certificateOwner(ctx, ledger, crt))
+	if provisioners.IsPending(err) {
+		log.Info("certificate request is waiting to be signed on the Puppet CA", "message", err.Error())
+		if err := r.annotateSubmission(ctx, cr); err != nil {
+			log.Error(err, "failed to record the submission of the certificate request")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: manualSigningPollInterval}, r.setPending(ctx, cr, "Certificate request submitted to the Puppet CA, %v", err)
+	}
+	if provisioners.IsDenied(err) || provisioners.IsRejected(err) {
+		// Denied requests are not retried, as they would be denied again
+		log.Info("certificate request denied", "message", err.Error())
+		metrics.RecordFailure(key.Kind, key.NamespacedName, metrics.OperationIssue, certificateRequestReasonDenied)
+		failureTime := meta.Now()
+		cr.Status.FailureTime = &failureTime
+		return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionFalse, certificateRequestReasonDenied, "Certificate request denied: %v", err)
+	}
 	if err != nil {
+		metrics.RecordFailure(key.Kind, key.NamespacedName, metrics.OperationIssue, operationFailureReason(err))
+		if isTransient(err) {
+			if maxRetry := iss.GetSpec().MaxRetryDuration; maxRetry == nil || time.Since(cr.CreationTimestamp.Time) < maxRetry.Duration {
+				// Returning the error requeues the request with exponential
+				// backoff
+				log.Error(err, "failed to sign certificate request, retrying")
+				_ = r.setPending(ctx, cr, "Failed to sign certificate request, retrying: %v", err)
+				return ctrl.Result{}, err
+			}
+			err = fmt.Errorf("giving up after %s: %w", iss.GetSpec().MaxRetryDuration.Duration, err)
+		}
+
 		log.Error(err, "failed to sign certificate request")
+		failureTime := meta.Now()
+		cr.Status.FailureTime = &failureTime
 		return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonFailed, "Failed to sign certificate request: %v", err)
 	}
+	if crt != nil {
+		if err := r.recordCertname(ctx, ledger, cr, crt, iss.GetSpec(), signedPEM); err != nil {
+			log.Error(err, "failed to record certname in the ledger")
+			return ctrl.Result{}, err
+		}
+	}
+	metrics.RecordSuccess(key.Kind, key.NamespacedName, metrics.OperationIssue, cmapi.CertificateRequestReasonIssued)
 	cr.Status.Certificate = signedPEM
-	//cr.Status.CA = trustedCAs
+	cr.Status.CA = trustedCAs
 
 	return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionTrue, cmapi.CertificateRequestReasonIssued, "Certificate issued")
 }
@@ -125,18 +232,22 @@ func (r *CertificateRequestReconciler) Reconcile(req ctrl.Request) (ctrl.Result,
 // SetupWithManager initializes the CertificateRequest controller into the
 // controller runtime.
 func (r *CertificateRequestReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := r.setupManagerContext(mgr); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&cmapi.CertificateRequest{}).
 		Complete(r)
 }
 
-// PuppetCAIssuerHasCondition will return true if the given PuppetCAIssuer resource has
-// a condition matching the provided PuppetCAIssuerCondition. Only the Type and
+// PuppetCAIssuerHasCondition will return true if the given PuppetCAIssuer or
+// PuppetCAClusterIssuer resource has a condition matching the provided
+// condition. Only the Type and
 // Status field will be used in the comparison, meaning that this function will
 // return 'true' even if the Reason, Message and LastTransitionTime fields do
 // not match.
-func PuppetCAIssuerHasCondition(iss api.PuppetCAIssuer, c api.PuppetCAIssuerCondition) bool {
-	existingConditions := iss.Status.Conditions
+func PuppetCAIssuerHasCondition(iss api.GenericIssuer, c meta.Condition) bool {
+	existingConditions := iss.GetStatus().Conditions
 	for _, cond := range existingConditions {
 		if c.Type == cond.Type && c.Status == cond.Status {
 			return true
@@ -145,6 +256,139 @@ func PuppetCAIssuerHasCondition(iss api.PuppetCAIssuer, c api.PuppetCAIssuerCond
 	return false
 }
 
+// isTransient returns true if err, returned by Sign, is worth retrying. Besides
+// the transient Puppet CA errors, this covers the transient errors of the
+// Kubernetes API, which is queried to check the ownership of certificates.
+func isTransient(err error) bool {
+	return provisioners.IsTransient(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err)
+}
+
+// getCertificate returns the Certificate for which cr was created, or nil if
+// cr was not created for a Certificate. The Certificate is the controller
+// reference cert-manager sets on the requests it creates, and must still have
+// the referenced UID. The certificate-name annotation is not trusted, as
+// whoever may create CertificateRequests may set it.
+func (r *CertificateRequestReconciler) getCertificate(ctx context.Context, cr *cmapi.CertificateRequest) (*cmapi.Certificate, error) {
+	ref := meta.GetControllerOf(cr)
+	if ref == nil || ref.Kind != cmapi.CertificateKind {
+		return nil, nil
+	}
+	if gv, err := schema.ParseGroupVersion(ref.APIVersion); err != nil || gv.Group != cmapi.SchemeGroupVersion.Group {
+		return nil, nil
+	}
+
+	crt := new(cmapi.Certificate)
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: ref.Name}, crt); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if crt.UID != ref.UID {
+		return nil, nil
+	}
+	return crt, nil
+}
+
+// certificateOwner returns an OwnerFunc accepting only the certificates the
+// ledger attributes to crt, which is how an existing certificate on the
+// Puppet CA is recognized as the one being renewed. Certificates missing from
+// the ledger are never accepted: the Secret of crt cannot vouch for them, as
+// whoever may create Secrets in its namespace controls its content.
+func certificateOwner(ctx context.Context, ledger *certnameLedger, crt *cmapi.Certificate) provisioners.OwnerFunc {
+	if crt == nil {
+		return func(string, *x509.Certificate) (bool, error) {
+			return false, nil
+		}
+	}
+	return ledger.OwnerFunc(ctx, crt.UID)
+}
+
+// recordCertname attributes the certname of cr to crt in the ledger, with the
+// serial number of the signed certificate.
+func (r *CertificateRequestReconciler) recordCertname(ctx context.Context, ledger *certnameLedger,
+	cr *cmapi.CertificateRequest, crt *cmapi.Certificate, spec *api.PuppetCAIssuerSpec, signedPEM []byte) error {
+
+	certname, err := provisioners.CertificateRequestCertname(cr, spec)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(signedPEM)
+	if block == nil {
+		return fmt.Errorf("no certificate found in the signed PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	return ledger.Record(ctx, certname, ledgerEntry{
+		Serial:         cert.SerialNumber.String(),
+		CertificateUID: crt.UID,
+		Namespace:      crt.Namespace,
+		Name:           crt.Name,
+		IssuedAt:       meta.Now(),
+	})
+}
+
+// annotateTrustedFacts surfaces the Puppet extensions of the CSR of cr as
+// annotations, so that users can see which trusted facts a certificate
+// carries. An invalid CSR is left for Sign to report.
+func (r *CertificateRequestReconciler) annotateTrustedFacts(ctx context.Context, cr *cmapi.CertificateRequest) error {
+	facts, err := provisioners.TrustedFacts(cr.Spec.Request)
+	if err != nil {
+		return nil
+	}
+
+	changed := false
+	for _, fact := range facts {
+		key := api.TrustedFactAnnotationPrefix + fact.Name
+		if value, ok := cr.Annotations[key]; ok && value == fact.Value {
+			continue
+		}
+		if cr.Annotations == nil {
+			cr.Annotations = map[string]string{}
+		}
+		cr.Annotations[key] = fact.Value
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return r.Client.Update(ctx, cr)
+}
+
+// annotateSubmission records on cr when its CSR was submitted to the Puppet
+// CA for a manual signature, so that Sign does not submit it again once a
+// Puppet administrator has rejected it.
+func (r *CertificateRequestReconciler) annotateSubmission(ctx context.Context, cr *cmapi.CertificateRequest) error {
+	if _, ok := cr.Annotations[api.SubmittedAtAnnotationKey]; ok {
+		return nil
+	}
+	if cr.Annotations == nil {
+		cr.Annotations = map[string]string{}
+	}
+	cr.Annotations[api.SubmittedAtAnnotationKey] = meta.Now().UTC().Format(time.RFC3339)
+	return r.Client.Update(ctx, cr)
+}
+
+// setPending sets the CertificateRequest Ready condition to Pending, unless
+// it is already set with the same message, so that polling the Puppet CA does
+// not fire an Event every time.
+func (r *CertificateRequestReconciler) setPending(ctx context.Context, cr *cmapi.CertificateRequest, message string, args ...interface{}) error {
+	completeMessage := fmt.Sprintf(message, args...)
+	cond := apiutil.GetCertificateRequestCondition(cr, cmapi.CertificateRequestConditionReady)
+	if cond != nil && cond.Reason == cmapi.CertificateRequestReasonPending && cond.Message == completeMessage {
+		return nil
+	}
+	return r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending, "%s", completeMessage)
+}
+
 func (r *CertificateRequestReconciler) setStatus(ctx context.Context, cr *cmapi.CertificateRequest, status cmmeta.ConditionStatus, reason, message string, args ...interface{}) error {
 	completeMessage := fmt.Sprintf(message, args...)
 	apiutil.SetCertificateRequestCondition(cr, cmapi.CertificateRequestConditionReady, status, reason, completeMessage)
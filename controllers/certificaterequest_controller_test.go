@@ -0,0 +1,103 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetCertificate(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmapi.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	crt := &cmapi.Certificate{ObjectMeta: meta.ObjectMeta{Namespace: "default", Name: "web", UID: "web"}}
+	other := &cmapi.Certificate{ObjectMeta: meta.ObjectMeta{Namespace: "default", Name: "db", UID: "db"}}
+	r := &CertificateRequestReconciler{Client: fake.NewFakeClientWithScheme(scheme, crt, other)}
+
+	controllerRef := func(crt *cmapi.Certificate) []meta.OwnerReference {
+		return []meta.OwnerReference{*meta.NewControllerRef(crt, cmapi.SchemeGroupVersion.WithKind(cmapi.CertificateKind))}
+	}
+	stale := controllerRef(crt)
+	stale[0].UID = "recreated"
+	notController := controllerRef(crt)
+	notController[0].Controller = nil
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		owners      []meta.OwnerReference
+		want        *cmapi.Certificate
+	}{
+		{
+			name: "no owner",
+		},
+		{
+			name:   "controlled by a Certificate",
+			owners: controllerRef(crt),
+			want:   crt,
+		},
+		{
+			name:        "annotation naming another Certificate",
+			annotations: map[string]string{cmapi.CertificateNameKey: "db"},
+			owners:      controllerRef(crt),
+			want:        crt,
+		},
+		{
+			name:        "annotation only",
+			annotations: map[string]string{cmapi.CertificateNameKey: "web"},
+		},
+		{
+			name:   "UID mismatch",
+			owners: stale,
+		},
+		{
+			name:   "not the controller",
+			owners: notController,
+		},
+		{
+			name:   "missing Certificate",
+			owners: controllerRef(&cmapi.Certificate{ObjectMeta: meta.ObjectMeta{Namespace: "default", Name: "gone", UID: "gone"}}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &cmapi.CertificateRequest{ObjectMeta: meta.ObjectMeta{
+				Namespace:       "default",
+				Name:            "web-1",
+				Annotations:     tt.annotations,
+				OwnerReferences: tt.owners,
+			}}
+			got, err := r.getCertificate(context.Background(), cr)
+			if err != nil {
+				t.Fatalf("getCertificate() error = %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && got.UID != tt.want.UID {
+				t.Errorf("getCertificate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
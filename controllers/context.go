@@ -0,0 +1,51 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// managerContext provides the reconcilers with a context cancelled when the
+// manager stops, so that in-flight Puppet CA calls are cancelled on shutdown.
+// This version of controller-runtime does not pass a context to Reconcile.
+type managerContext struct {
+	ctx context.Context
+}
+
+// setupManagerContext creates the context and registers its cancellation
+// with mgr.
+func (m *managerContext) setupManagerContext(mgr ctrl.Manager) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.ctx = ctx
+	return mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		<-stop
+		cancel()
+		return nil
+	}))
+}
+
+// context returns the context of the manager, or a background context if
+// the reconciler was not set up with a manager.
+func (m *managerContext) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
@@ -0,0 +1,270 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/camptocamp/puppetca-issuer/provisioners"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+// Default keys of the credentials, matching the kubernetes.io/tls Secret
+// layout produced by cert-manager.
+const (
+	defaultURLKey    = "url"
+	defaultCertKey   = "tls.crt"
+	defaultKeyKey    = "tls.key"
+	defaultCACertKey = "ca.crt"
+)
+
+// Default keys of the credentials read from the Secret named by secretName,
+// matching the layout of the credentials Secret of earlier versions.
+const (
+	legacyURLKey    = "url"
+	legacyCertKey   = "cert"
+	legacyKeyKey    = "key"
+	legacyCACertKey = "cacert"
+)
+
+// credentialRef is a credential of the provisioner read from a Secret, a
+// ConfigMap or a file.
+type credentialRef struct {
+	// field is the path of the reference in the issuer spec.
+	field string
+	// what describes the credential in error messages.
+	what string
+	api.SecretKeySelector
+}
+
+// missingKeyError is returned when a referenced Secret or ConfigMap does not
+// contain the selected key.
+type missingKeyError struct {
+	kind string
+	name string
+	key  string
+}
+
+func (e *missingKeyError) Error() string {
+	return fmt.Sprintf("%s %s does not contain key %s", e.kind, e.name, e.key)
+}
+
+// isMissingKey returns true if err is a *missingKeyError.
+func isMissingKey(err error) bool {
+	var missingKeyErr *missingKeyError
+	return errors.As(err, &missingKeyErr)
+}
+
+// credentialRefs returns the references of p which are in use, with their
+// defaults applied. The URL and CA certificate references are not used when
+// set in plain in the spec. References to the Secret named by secretName
+// default to its legacy keys, and the others to the kubernetes.io/tls ones.
+func credentialRefs(p api.PuppetCAProvisioner) []credentialRef {
+	var refs []credentialRef
+	add := func(field, what string, sel api.SecretKeySelector, defaultKey, legacyKey string) {
+		if sel.Kind == "" {
+			sel.Kind = api.CredentialSourceSecret
+		}
+		if sel.Name == "" && sel.Kind == api.CredentialSourceSecret {
+			sel.Name = p.Name
+			defaultKey = legacyKey
+		}
+		if sel.Key == "" {
+			sel.Key = defaultKey
+		}
+		refs = append(refs, credentialRef{field: field, what: what, SecretKeySelector: sel})
+	}
+
+	if len(p.Endpoints) == 0 {
+		add("spec.provisioner.url", "URL", p.URLRef, defaultURLKey, legacyURLKey)
+	}
+	add("spec.provisioner.cert", "certificate", p.CertRef, defaultCertKey, legacyCertKey)
+	add("spec.provisioner.key", "key", p.KeyRef, defaultKeyKey, legacyKeyKey)
+	if p.CABundle == "" {
+		add("spec.provisioner.cacert", "CA certificate", p.CaCertRef, defaultCACertKey, legacyCACertKey)
+	}
+	return refs
+}
+
+// validateCredentialRefs checks that the references of p can be resolved.
+func validateCredentialRefs(p api.PuppetCAProvisioner) error {
+	for _, ref := range credentialRefs(p) {
+		switch {
+		case ref.Kind != api.CredentialSourceSecret && ref.Kind != api.CredentialSourceConfigMap && ref.Kind != api.CredentialSourceFile:
+			return fmt.Errorf("%s.kind must be one of %s, %s or %s", ref.field, api.CredentialSourceSecret, api.CredentialSourceConfigMap, api.CredentialSourceFile)
+		case ref.Kind == api.CredentialSourceConfigMap && ref.field == "spec.provisioner.key":
+			return fmt.Errorf("%s.kind must be %s or %s", ref.field, api.CredentialSourceSecret, api.CredentialSourceFile)
+		case ref.Kind == api.CredentialSourceFile && !filepath.IsAbs(ref.Path):
+			return fmt.Errorf("%s.path must be an absolute path", ref.field)
+		case ref.Kind == api.CredentialSourceFile:
+			// Files are not looked up by name
+			continue
+		case ref.Name == "" && ref.Kind == api.CredentialSourceSecret:
+			return fmt.Errorf("%s.name cannot be empty unless spec.provisioner.secretName is set", ref.field)
+		case ref.Name == "":
+			return fmt.Errorf("%s.name cannot be empty", ref.field)
+		}
+		if errs := validation.IsConfigMapKey(ref.Key); len(errs) > 0 {
+			return fmt.Errorf("%s.key %q is invalid: %s", ref.field, ref.Key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// validateCredentialSources checks that only PuppetCAClusterIssuers read
+// their credentials from files. The files of the controller pod must not be
+// usable by whoever may create PuppetCAIssuers in a namespace.
+func validateCredentialSources(iss api.GenericIssuer) error {
+	if _, ok := iss.(*api.PuppetCAClusterIssuer); ok {
+		return nil
+	}
+	for _, ref := range credentialRefs(iss.GetSpec().Provisioner) {
+		if ref.Kind == api.CredentialSourceFile {
+			return fmt.Errorf("%s.kind %s is only allowed for %s resources", ref.field, api.CredentialSourceFile, api.PuppetCAClusterIssuerKind)
+		}
+	}
+	return nil
+}
+
+// validateNoSecretAccess checks that s neither reads credentials from Secrets
+// nor publishes its CRL into one, as required when the controller runs
+// without access to Secrets.
+func validateNoSecretAccess(s api.PuppetCAIssuerSpec) error {
+	for _, ref := range credentialRefs(s.Provisioner) {
+		if ref.Kind == api.CredentialSourceSecret {
+			return fmt.Errorf("%s.kind %s is not allowed, as the controller has no access to Secrets", ref.field, ref.Kind)
+		}
+	}
+	if s.CRL != nil && s.CRL.Kind == "Secret" {
+		return fmt.Errorf("spec.crl.kind Secret is not allowed, as the controller has no access to Secrets")
+	}
+	return nil
+}
+
+// credentialFiles returns the paths of the files p reads credentials from.
+func credentialFiles(p api.PuppetCAProvisioner) []string {
+	var paths []string
+	for _, ref := range credentialRefs(p) {
+		if ref.Kind == api.CredentialSourceFile {
+			paths = append(paths, ref.Path)
+		}
+	}
+	return paths
+}
+
+// loadCredentials reads the credentials of p from the Secrets and ConfigMaps
+// of namespace and from files, or from the spec for the URL and CA
+// certificate.
+func loadCredentials(ctx context.Context, c client.Client, p api.PuppetCAProvisioner, namespace string) (provisioners.Credentials, error) {
+	creds := provisioners.Credentials{
+		URLs:   p.Endpoints,
+		CACert: p.CABundle,
+	}
+
+	for _, ref := range credentialRefs(p) {
+		value, err := readCredential(ctx, c, namespace, ref.SecretKeySelector)
+		if err != nil {
+			return provisioners.Credentials{}, fmt.Errorf("Puppet CA %s: %w", ref.what, err)
+		}
+		switch ref.field {
+		case "spec.provisioner.url":
+			creds.URLs = []string{value}
+		case "spec.provisioner.cert":
+			creds.Cert = value
+		case "spec.provisioner.key":
+			creds.Key = value
+		case "spec.provisioner.cacert":
+			creds.CACert = value
+		}
+	}
+	return creds, nil
+}
+
+// readCredential returns the value selected by sel in namespace.
+func readCredential(ctx context.Context, c client.Client, namespace string, sel api.SecretKeySelector) (string, error) {
+	nn := types.NamespacedName{Namespace: namespace, Name: sel.Name}
+
+	switch sel.Kind {
+	case api.CredentialSourceFile:
+		value, err := ioutil.ReadFile(sel.Path)
+		if err != nil {
+			return "", err
+		}
+		return string(value), nil
+
+	case api.CredentialSourceConfigMap:
+		var cm core.ConfigMap
+		if err := c.Get(ctx, nn, &cm); err != nil {
+			return "", err
+		}
+		if value, ok := cm.Data[sel.Key]; ok {
+			return value, nil
+		}
+		if value, ok := cm.BinaryData[sel.Key]; ok {
+			return string(value), nil
+		}
+		return "", &missingKeyError{kind: "configmap", name: sel.Name, key: sel.Key}
+	}
+
+	var secret core.Secret
+	if err := c.Get(ctx, nn, &secret); err != nil {
+		return "", err
+	}
+	value, ok := secret.Data[sel.Key]
+	if !ok {
+		return "", &missingKeyError{kind: "secret", name: sel.Name, key: sel.Key}
+	}
+	return string(value), nil
+}
+
+// issuerSecretNames is the indexer function for secretNameIndexKey.
+func issuerSecretNames(o runtime.Object) []string {
+	return issuerCredentialNames(o, api.CredentialSourceSecret)
+}
+
+// issuerConfigMapNames is the indexer function for configMapNameIndexKey.
+func issuerConfigMapNames(o runtime.Object) []string {
+	return issuerCredentialNames(o, api.CredentialSourceConfigMap)
+}
+
+// issuerCredentialNames returns the names of the resources of the given kind
+// the issuer reads its credentials from.
+func issuerCredentialNames(o runtime.Object, kind api.CredentialSourceKind) []string {
+	iss, ok := o.(api.GenericIssuer)
+	if !ok {
+		return nil
+	}
+
+	var names []string
+	for _, ref := range credentialRefs(iss.GetSpec().Provisioner) {
+		if ref.Kind == kind && ref.Name != "" && !containsString(names, ref.Name) {
+			names = append(names, ref.Name)
+		}
+	}
+	return names
+}
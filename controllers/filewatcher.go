@@ -0,0 +1,176 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/camptocamp/puppetca-issuer/provisioners"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+// CredentialFileWatcher watches the files issuers read their credentials
+// from, and triggers the reconciliation of the issuers when the files change
+// so that their Puppet CA client is rebuilt with the new credentials.
+//
+// The directories of the files are watched rather than the files themselves,
+// as Kubernetes volumes are updated by swapping a symlink to a new directory.
+type CredentialFileWatcher struct {
+	log     logr.Logger
+	watcher *fsnotify.Watcher
+
+	// events receives the issuers to reconcile, per issuer kind.
+	events map[string]chan event.GenericEvent
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// dirs holds the directories watched for each issuer.
+	dirs map[provisioners.Key][]string
+	// watched counts the issuers watching each directory.
+	watched map[string]int
+}
+
+// NewCredentialFileWatcher returns a CredentialFileWatcher. It must be added
+// to the manager to start watching.
+func NewCredentialFileWatcher(log logr.Logger) (*CredentialFileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &CredentialFileWatcher{
+		log:     log,
+		watcher: watcher,
+		events: map[string]chan event.GenericEvent{
+			api.PuppetCAIssuerKind:        make(chan event.GenericEvent, 16),
+			api.PuppetCAClusterIssuerKind: make(chan event.GenericEvent, 16),
+		},
+		dirs:    make(map[provisioners.Key][]string),
+		watched: make(map[string]int),
+	}, nil
+}
+
+// Source returns the source of the reconcile events of the issuers of the
+// given kind.
+func (w *CredentialFileWatcher) Source(kind string) source.Source {
+	return &source.Channel{Source: w.events[kind]}
+}
+
+// Watch sets the files read by the issuer identified by key, replacing the
+// ones set previously. An empty list stops watching for the issuer.
+func (w *CredentialFileWatcher) Watch(key provisioners.Key, paths []string) error {
+	var dirs []string
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if !containsString(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, dir := range dirs {
+		if w.watched[dir] == 0 {
+			if err := w.watcher.Add(dir); err != nil {
+				w.release(dirs[:i])
+				return err
+			}
+			w.log.Info("watching credential files", "directory", dir)
+		}
+		w.watched[dir]++
+	}
+	w.release(w.dirs[key])
+
+	if len(dirs) == 0 {
+		delete(w.dirs, key)
+	} else {
+		w.dirs[key] = dirs
+	}
+	return nil
+}
+
+// release stops watching dirs on behalf of an issuer. It must be called with
+// mu held.
+func (w *CredentialFileWatcher) release(dirs []string) {
+	for _, dir := range dirs {
+		w.watched[dir]--
+		if w.watched[dir] == 0 {
+			delete(w.watched, dir)
+			_ = w.watcher.Remove(dir)
+			w.log.Info("stopped watching credential files", "directory", dir)
+		}
+	}
+}
+
+// Start watches the files until stop is closed. It implements
+// manager.Runnable.
+func (w *CredentialFileWatcher) Start(stop <-chan struct{}) error {
+	defer w.watcher.Close()
+	for {
+		select {
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.notify(filepath.Dir(ev.Name), stop)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			w.log.Error(err, "failed to watch credential files")
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// notify sends a reconcile event for each issuer reading files in dir.
+func (w *CredentialFileWatcher) notify(dir string, stop <-chan struct{}) {
+	w.mu.Lock()
+	var keys []provisioners.Key
+	for key, dirs := range w.dirs {
+		if containsString(dirs, dir) {
+			keys = append(keys, key)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, key := range keys {
+		meta := metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}
+		var ev event.GenericEvent
+		if key.Kind == api.PuppetCAClusterIssuerKind {
+			iss := &api.PuppetCAClusterIssuer{ObjectMeta: meta}
+			ev = event.GenericEvent{Meta: iss, Object: iss}
+		} else {
+			iss := &api.PuppetCAIssuer{ObjectMeta: meta}
+			ev = event.GenericEvent{Meta: iss, Object: iss}
+		}
+
+		select {
+		case w.events[key.Kind] <- ev:
+		case <-stop:
+			return
+		}
+	}
+}
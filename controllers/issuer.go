@@ -0,0 +1,97 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/camptocamp/puppetca-issuer/api/v1alpha2"
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	"github.com/camptocamp/puppetca-issuer/provisioners"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// issuerKind returns the kind of the given issuer. The TypeMeta of objects
+// read through the client is not reliably populated, so it is not used here.
+func issuerKind(iss api.GenericIssuer) string {
+	if _, ok := iss.(*api.PuppetCAClusterIssuer); ok {
+		return api.PuppetCAClusterIssuerKind
+	}
+	return api.PuppetCAIssuerKind
+}
+
+// issuerKey returns the key under which the provisioner of the given issuer
+// is stored.
+func issuerKey(iss api.GenericIssuer) provisioners.Key {
+	return provisioners.Key{
+		Kind: issuerKind(iss),
+		NamespacedName: types.NamespacedName{
+			Namespace: iss.GetNamespace(),
+			Name:      iss.GetName(),
+		},
+	}
+}
+
+// isSupportedIssuerGroup returns true if group is the API group of the
+// issuers handled by this controller. References to the deprecated
+// certmanager.puppetca group are supported too, and resolve to the issuers
+// migrated from it. An empty group is accepted as well.
+func isSupportedIssuerGroup(group string) bool {
+	switch group {
+	case "", api.GroupVersion.Group, v1alpha2.GroupVersion.Group:
+		return true
+	default:
+		return false
+	}
+}
+
+// isSupportedIssuerKind returns true if kind is handled by this controller.
+// An empty kind defaults to PuppetCAIssuer.
+func isSupportedIssuerKind(kind string) bool {
+	switch kind {
+	case "", api.PuppetCAIssuerKind, api.PuppetCAClusterIssuerKind:
+		return true
+	default:
+		return false
+	}
+}
+
+// getIssuer fetches the issuer referenced by ref for a resource living in
+// namespace. PuppetCAClusterIssuer references ignore the namespace.
+func getIssuer(ctx context.Context, c client.Client, ref cmmeta.ObjectReference, namespace string) (api.GenericIssuer, types.NamespacedName, error) {
+	var iss api.GenericIssuer
+	issNamespaceName := types.NamespacedName{
+		Name: ref.Name,
+	}
+
+	switch ref.Kind {
+	case "", api.PuppetCAIssuerKind:
+		iss = new(api.PuppetCAIssuer)
+		issNamespaceName.Namespace = namespace
+	case api.PuppetCAClusterIssuerKind:
+		iss = new(api.PuppetCAClusterIssuer)
+	default:
+		return nil, issNamespaceName, fmt.Errorf("unsupported issuer kind %q", ref.Kind)
+	}
+
+	if err := c.Get(ctx, issNamespaceName, iss); err != nil {
+		return nil, issNamespaceName, err
+	}
+	return iss, issNamespaceName, nil
+}
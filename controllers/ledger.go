@@ -0,0 +1,212 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	"github.com/camptocamp/puppetca-issuer/provisioners"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ledgerEntry records which Certificate a certname was issued for.
+type ledgerEntry struct {
+	Serial         string    `json:"serial"`
+	CertificateUID types.UID `json:"certificateUID"`
+	Namespace      string    `json:"namespace"`
+	Name           string    `json:"name"`
+	IssuedAt       meta.Time `json:"issuedAt"`
+}
+
+// certnameLedger is the ownership ledger of the certnames issued through an
+// issuer. It is stored in a ConfigMap of the cluster resource namespace,
+// mapping each certname to its ledgerEntry. Certificates on the Puppet CA are
+// only replaced, cleaned or revoked on behalf of the Certificate the ledger
+// attributes them to, so that deleting a Certificate never affects a
+// certificate issued by someone else, such as the Puppet server's own.
+type certnameLedger struct {
+	client client.Client
+	issuer api.GenericIssuer
+	key    types.NamespacedName
+}
+
+// newCertnameLedger returns the ledger of iss. The ConfigMap lives in
+// ledgerNamespace, the cluster resource namespace, rather than in the
+// namespace of a PuppetCAIssuer, where whoever may edit ConfigMaps could forge
+// entries and claim any certname.
+func newCertnameLedger(c client.Client, iss api.GenericIssuer, ledgerNamespace string) *certnameLedger {
+	return &certnameLedger{
+		client: c,
+		issuer: iss,
+		key:    certnameLedgerKey(issuerKey(iss), ledgerNamespace),
+	}
+}
+
+// certnameLedgerKey returns the key of the ledger ConfigMap of the issuer
+// identified by key.
+func certnameLedgerKey(key provisioners.Key, ledgerNamespace string) types.NamespacedName {
+	kind := strings.ToLower(key.Kind)
+	name := fmt.Sprintf("%s-%s-certnames", kind, key.Name)
+	if key.Namespace != "" {
+		// Namespace names cannot contain dots, which keeps the ledgers of
+		// issuers of different namespaces apart
+		name = fmt.Sprintf("%s.%s.%s-certnames", kind, key.Namespace, key.Name)
+	}
+	if len(name) > validation.DNS1123SubdomainMaxLength {
+		sum := sha256.Sum256([]byte(key.Namespace + "/" + key.Name))
+		name = fmt.Sprintf("%s.%x-certnames", kind, sum[:16])
+	}
+	return types.NamespacedName{Namespace: ledgerNamespace, Name: name}
+}
+
+// deleteCertnameLedger deletes the ledger of the deleted issuer identified by
+// key. The ledgers of PuppetCAClusterIssuers are owned by them and garbage
+// collected instead, but PuppetCAIssuers cannot own a ConfigMap of another
+// namespace.
+func deleteCertnameLedger(ctx context.Context, c client.Client, key provisioners.Key, ledgerNamespace string) error {
+	nn := certnameLedgerKey(key, ledgerNamespace)
+	configMap := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name}}
+	return client.IgnoreNotFound(c.Delete(ctx, configMap))
+}
+
+// Lookup returns the entry of certname, or nil if the ledger does not know
+// certname.
+func (l *certnameLedger) Lookup(ctx context.Context, certname string) (*ledgerEntry, error) {
+	configMap := new(core.ConfigMap)
+	if err := l.client.Get(ctx, l.key, configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	data, ok := configMap.Data[certname]
+	if !ok {
+		return nil, nil
+	}
+	entry := new(ledgerEntry)
+	if err := json.Unmarshal([]byte(data), entry); err != nil {
+		return nil, fmt.Errorf("invalid ledger entry for %s: %v", certname, err)
+	}
+	return entry, nil
+}
+
+// Certnames returns the certnames the ledger attributes to the Certificate
+// with the given UID, sorted. There are several of them when the certname
+// template of the issuer changed while the Certificate was renewed.
+func (l *certnameLedger) Certnames(ctx context.Context, uid types.UID) ([]string, error) {
+	configMap := new(core.ConfigMap)
+	if err := l.client.Get(ctx, l.key, configMap); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+
+	var certnames []string
+	for certname, data := range configMap.Data {
+		entry := new(ledgerEntry)
+		if err := json.Unmarshal([]byte(data), entry); err != nil {
+			return nil, fmt.Errorf("invalid ledger entry for %s: %v", certname, err)
+		}
+		if entry.CertificateUID == uid {
+			certnames = append(certnames, certname)
+		}
+	}
+	sort.Strings(certnames)
+	return certnames, nil
+}
+
+// Record attributes certname to entry, replacing any previous entry.
+func (l *certnameLedger) Record(ctx context.Context, certname string, entry ledgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap := new(core.ConfigMap)
+		err := l.client.Get(ctx, l.key, configMap)
+		if apierrors.IsNotFound(err) {
+			configMap = &core.ConfigMap{
+				ObjectMeta: meta.ObjectMeta{
+					Namespace: l.key.Namespace,
+					Name:      l.key.Name,
+				},
+				Data: map[string]string{certname: string(data)},
+			}
+			// A cluster issuer owns its ledger, so that it is removed with
+			// it
+			if l.issuer.GetNamespace() == "" {
+				configMap.OwnerReferences = []meta.OwnerReference{
+					*meta.NewControllerRef(l.issuer, api.GroupVersion.WithKind(issuerKind(l.issuer))),
+				}
+			}
+			return l.client.Create(ctx, configMap)
+		}
+		if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[certname] = string(data)
+		return l.client.Update(ctx, configMap)
+	})
+}
+
+// Forget removes the entry of certname.
+func (l *certnameLedger) Forget(ctx context.Context, certname string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap := new(core.ConfigMap)
+		if err := l.client.Get(ctx, l.key, configMap); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		if _, ok := configMap.Data[certname]; !ok {
+			return nil
+		}
+		delete(configMap.Data, certname)
+		return l.client.Update(ctx, configMap)
+	})
+}
+
+// OwnerFunc returns a provisioners.OwnerFunc accepting only the certificates
+// the ledger attributes to the Certificate with the given UID. When cert is
+// known, its serial number must match the recorded one too.
+func (l *certnameLedger) OwnerFunc(ctx context.Context, uid types.UID) provisioners.OwnerFunc {
+	return func(certname string, cert *x509.Certificate) (bool, error) {
+		entry, err := l.Lookup(ctx, certname)
+		if err != nil || entry == nil {
+			return false, err
+		}
+		if entry.CertificateUID != uid {
+			return false, nil
+		}
+		return cert == nil || entry.Serial == cert.SerialNumber.String(), nil
+	}
+}
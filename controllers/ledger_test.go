@@ -0,0 +1,208 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	"github.com/camptocamp/puppetca-issuer/provisioners"
+)
+
+func TestCertnameLedgerKey(t *testing.T) {
+	long := strings.Repeat("a", validation.DNS1123SubdomainMaxLength)
+
+	tests := []struct {
+		name     string
+		key      provisioners.Key
+		want     string
+		wantHash bool
+	}{
+		{
+			name: "cluster issuer",
+			key:  provisioners.Key{Kind: api.PuppetCAClusterIssuerKind, NamespacedName: types.NamespacedName{Name: "puppetca"}},
+			want: "puppetcaclusterissuer-puppetca-certnames",
+		},
+		{
+			name: "namespaced issuer",
+			key:  provisioners.Key{Kind: api.PuppetCAIssuerKind, NamespacedName: types.NamespacedName{Namespace: "default", Name: "puppetca"}},
+			want: "puppetcaissuer.default.puppetca-certnames",
+		},
+		{
+			name:     "long name",
+			key:      provisioners.Key{Kind: api.PuppetCAIssuerKind, NamespacedName: types.NamespacedName{Namespace: "default", Name: long}},
+			wantHash: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := certnameLedgerKey(tt.key, "cert-manager")
+			if got.Namespace != "cert-manager" {
+				t.Errorf("certnameLedgerKey() namespace = %s, want cert-manager", got.Namespace)
+			}
+			if errs := validation.IsDNS1123Subdomain(got.Name); len(errs) > 0 {
+				t.Errorf("certnameLedgerKey() name = %s is invalid: %v", got.Name, errs)
+			}
+			if tt.wantHash {
+				if !strings.HasPrefix(got.Name, "puppetcaissuer.") || len(got.Name) != len("puppetcaissuer.")+32+len("-certnames") {
+					t.Errorf("certnameLedgerKey() name = %s, want a hashed name", got.Name)
+				}
+				return
+			}
+			if got.Name != tt.want {
+				t.Errorf("certnameLedgerKey() name = %s, want %s", got.Name, tt.want)
+			}
+		})
+	}
+
+	// Issuers of different namespaces do not share a ledger
+	a := certnameLedgerKey(provisioners.Key{Kind: api.PuppetCAIssuerKind, NamespacedName: types.NamespacedName{Namespace: "a", Name: long}}, "cert-manager")
+	b := certnameLedgerKey(provisioners.Key{Kind: api.PuppetCAIssuerKind, NamespacedName: types.NamespacedName{Namespace: "b", Name: long}}, "cert-manager")
+	if a == b {
+		t.Errorf("certnameLedgerKey() = %s for both namespaces", a)
+	}
+}
+
+func newLedgerTestClient(t *testing.T) client.Client {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewFakeClientWithScheme(scheme)
+}
+
+func TestCertnameLedger(t *testing.T) {
+	ctx := context.Background()
+	c := newLedgerTestClient(t)
+	iss := &api.PuppetCAClusterIssuer{ObjectMeta: meta.ObjectMeta{Name: "puppetca", UID: "issuer"}}
+	ledger := newCertnameLedger(c, iss, "cert-manager")
+
+	entry, err := ledger.Lookup(ctx, "web.example.com")
+	if err != nil || entry != nil {
+		t.Fatalf("Lookup() on a missing ledger = %v, %v, want nil, nil", entry, err)
+	}
+	if certnames, err := ledger.Certnames(ctx, "web"); err != nil || len(certnames) != 0 {
+		t.Fatalf("Certnames() on a missing ledger = %v, %v, want none", certnames, err)
+	}
+
+	web := ledgerEntry{Serial: "2", CertificateUID: "web", Namespace: "default", Name: "web"}
+	for _, certname := range []string{"web.example.com", "web"} {
+		if err := ledger.Record(ctx, certname, web); err != nil {
+			t.Fatalf("Record(%s) error = %v", certname, err)
+		}
+	}
+	if err := ledger.Record(ctx, "db.example.com", ledgerEntry{Serial: "3", CertificateUID: "db", Namespace: "default", Name: "db"}); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+
+	configMap := new(core.ConfigMap)
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "cert-manager", Name: "puppetcaclusterissuer-puppetca-certnames"}, configMap); err != nil {
+		t.Fatalf("failed to get the ledger ConfigMap: %v", err)
+	}
+	if len(configMap.OwnerReferences) != 1 || configMap.OwnerReferences[0].UID != iss.UID {
+		t.Errorf("ledger owner references = %+v, want the cluster issuer", configMap.OwnerReferences)
+	}
+
+	entry, err = ledger.Lookup(ctx, "web.example.com")
+	if err != nil || entry == nil || *entry != web {
+		t.Errorf("Lookup() = %+v, %v, want %+v", entry, err, web)
+	}
+	certnames, err := ledger.Certnames(ctx, "web")
+	if err != nil || !reflect.DeepEqual(certnames, []string{"web", "web.example.com"}) {
+		t.Errorf("Certnames() = %v, %v, want [web web.example.com]", certnames, err)
+	}
+
+	owner := ledger.OwnerFunc(ctx, "web")
+	ownerTests := []struct {
+		certname string
+		serial   int64
+		want     bool
+	}{
+		{certname: "web.example.com", want: true},
+		{certname: "web.example.com", serial: 2, want: true},
+		{certname: "web.example.com", serial: 4, want: false},
+		{certname: "db.example.com", want: false},
+		{certname: "puppet.example.com", want: false},
+	}
+	for _, tt := range ownerTests {
+		var cert *x509.Certificate
+		if tt.serial != 0 {
+			cert = &x509.Certificate{SerialNumber: big.NewInt(tt.serial)}
+		}
+		if got, err := owner(tt.certname, cert); err != nil || got != tt.want {
+			t.Errorf("OwnerFunc()(%s, serial %d) = %v, %v, want %v", tt.certname, tt.serial, got, err, tt.want)
+		}
+	}
+
+	if err := ledger.Forget(ctx, "web.example.com"); err != nil {
+		t.Fatalf("Forget() error = %v", err)
+	}
+	if err := ledger.Forget(ctx, "web.example.com"); err != nil {
+		t.Fatalf("Forget() of a forgotten certname error = %v", err)
+	}
+	if entry, err := ledger.Lookup(ctx, "web.example.com"); err != nil || entry != nil {
+		t.Errorf("Lookup() after Forget() = %+v, %v, want nil", entry, err)
+	}
+	if certnames, err := ledger.Certnames(ctx, "web"); err != nil || !reflect.DeepEqual(certnames, []string{"web"}) {
+		t.Errorf("Certnames() after Forget() = %v, %v, want [web]", certnames, err)
+	}
+}
+
+func TestDeleteCertnameLedger(t *testing.T) {
+	ctx := context.Background()
+	c := newLedgerTestClient(t)
+	iss := &api.PuppetCAIssuer{ObjectMeta: meta.ObjectMeta{Namespace: "default", Name: "puppetca"}}
+	ledger := newCertnameLedger(c, iss, "cert-manager")
+
+	if err := ledger.Record(ctx, "web.example.com", ledgerEntry{CertificateUID: "web"}); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	configMap := new(core.ConfigMap)
+	if err := c.Get(ctx, ledger.key, configMap); err != nil {
+		t.Fatalf("failed to get the ledger ConfigMap: %v", err)
+	}
+	// A namespaced issuer cannot own a ConfigMap of another namespace
+	if len(configMap.OwnerReferences) != 0 {
+		t.Errorf("ledger owner references = %+v, want none", configMap.OwnerReferences)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := deleteCertnameLedger(ctx, c, issuerKey(iss), "cert-manager"); err != nil {
+			t.Fatalf("deleteCertnameLedger() error = %v", err)
+		}
+	}
+	if err := c.Get(ctx, ledger.key, configMap); !apierrors.IsNotFound(err) {
+		t.Errorf("ledger ConfigMap still exists: %v", err)
+	}
+}
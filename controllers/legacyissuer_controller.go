@@ -0,0 +1,185 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+
+	"github.com/go-logr/logr"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/camptocamp/puppetca-issuer/api/v1alpha2"
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+// legacyIssuer is implemented by the issuers of the deprecated
+// certmanager.puppetca API group.
+type legacyIssuer interface {
+	v1alpha2.GenericIssuer
+	ConvertTo(conversion.Hub) error
+	ConvertFrom(conversion.Hub) error
+}
+
+// LegacyIssuerReconciler migrates the issuers of the deprecated
+// certmanager.puppetca API group to the puppetca.camptocamp.com group. Each
+// legacy issuer is copied to an issuer of the same name in the new group,
+// which is created if missing and follows the spec of the legacy issuer until
+// the latter is deleted. The status of the migrated issuer is reported on the
+// legacy one.
+type LegacyIssuerReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Recorder record.EventRecorder
+	managerContext
+
+	// Kind is the kind of the migrated issuers, PuppetCAIssuer or
+	// PuppetCAClusterIssuer.
+	Kind string
+}
+
+// +kubebuilder:rbac:groups=certmanager.puppetca,resources=puppetcaissuers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=certmanager.puppetca,resources=puppetcaissuers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=certmanager.puppetca,resources=puppetcaclusterissuers,verbs=get;list;watch
+// +kubebuilder:rbac:groups=certmanager.puppetca,resources=puppetcaclusterissuers/status,verbs=get;update;patch
+
+func (r *LegacyIssuerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := r.context()
+	log := r.Log.WithValues(strings.ToLower(r.Kind), req.NamespacedName)
+
+	legacy, iss := r.newIssuers()
+	if err := r.Client.Get(ctx, req.NamespacedName, legacy); err != nil {
+		// The migrated issuer is kept when the legacy one is deleted
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "failed to retrieve legacy issuer resource")
+		return ctrl.Result{}, err
+	}
+
+	_, migrated := r.newIssuers()
+	if err := legacy.ConvertTo(migrated.(conversion.Hub)); err != nil {
+		log.Error(err, "failed to convert legacy issuer resource")
+		return ctrl.Result{}, err
+	}
+	defaultIssuerSpec(migrated.GetSpec())
+
+	if err := r.Client.Get(ctx, req.NamespacedName, iss); err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Error(err, "failed to retrieve issuer resource")
+			return ctrl.Result{}, err
+		}
+
+		*migrated.GetObjectMeta() = migratedObjectMeta(legacy)
+		*migrated.GetStatus() = api.PuppetCAIssuerStatus{}
+		if err := r.Client.Create(ctx, migrated); err != nil {
+			log.Error(err, "failed to create migrated issuer resource")
+			r.Recorder.Eventf(legacy, core.EventTypeWarning, "MigrationFailed", "Failed to migrate to %s: %v", api.GroupVersion, err)
+			return ctrl.Result{}, err
+		}
+		log.Info("migrated legacy issuer resource")
+		r.Recorder.Eventf(legacy, core.EventTypeNormal, "Migrated", "Migrated to %s", api.GroupVersion)
+		return ctrl.Result{}, nil
+	}
+
+	// An issuer created in the new group is not overwritten
+	if _, ok := iss.GetAnnotations()[api.MigratedFromAnnotationKey]; !ok {
+		log.Info("issuer resource already exists and was not migrated, skipping")
+		r.Recorder.Eventf(legacy, core.EventTypeWarning, "MigrationConflict", "A %s of the same name already exists in %s", r.Kind, api.GroupVersion.Group)
+		return ctrl.Result{}, nil
+	}
+
+	if !equality.Semantic.DeepEqual(iss.GetSpec(), migrated.GetSpec()) {
+		*iss.GetSpec() = *migrated.GetSpec()
+		if err := r.Client.Update(ctx, iss); err != nil {
+			log.Error(err, "failed to update migrated issuer resource")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Report the status of the migrated issuer on the legacy one
+	reported, _ := r.newIssuers()
+	if err := reported.ConvertFrom(iss.(conversion.Hub)); err != nil {
+		log.Error(err, "failed to convert issuer status")
+		return ctrl.Result{}, err
+	}
+	if equality.Semantic.DeepEqual(legacy.GetStatus(), reported.GetStatus()) {
+		return ctrl.Result{}, nil
+	}
+	*legacy.GetStatus() = *reported.GetStatus()
+	return ctrl.Result{}, r.Client.Status().Update(ctx, legacy)
+}
+
+// SetupWithManager initializes the migration controller into the controller
+// runtime. It is not started if the legacy CRD is not installed, as there is
+// nothing to migrate then.
+func (r *LegacyIssuerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	gvk := v1alpha2.GroupVersion.WithKind(r.Kind)
+	if _, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+		if apimeta.IsNoMatchError(err) {
+			r.Log.Info("legacy CRD not installed, skipping migration", "kind", gvk)
+			return nil
+		}
+		return err
+	}
+	if err := r.setupManagerContext(mgr); err != nil {
+		return err
+	}
+
+	legacy, iss := r.newIssuers()
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("legacy"+strings.ToLower(r.Kind)).
+		For(legacy).
+		// The migrated issuer has the name of the legacy one
+		Watches(&source.Kind{Type: iss}, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
+
+// newIssuers returns an empty legacy issuer and an empty issuer of the kind
+// of r.
+func (r *LegacyIssuerReconciler) newIssuers() (legacyIssuer, api.GenericIssuer) {
+	if r.Kind == api.PuppetCAClusterIssuerKind {
+		return new(v1alpha2.PuppetCAClusterIssuer), new(api.PuppetCAClusterIssuer)
+	}
+	return new(v1alpha2.PuppetCAIssuer), new(api.PuppetCAIssuer)
+}
+
+// migratedObjectMeta returns the metadata of the issuer migrated from legacy,
+// which keeps its name, labels and annotations.
+func migratedObjectMeta(legacy legacyIssuer) meta.ObjectMeta {
+	annotations := map[string]string{}
+	for k, v := range legacy.GetAnnotations() {
+		annotations[k] = v
+	}
+	delete(annotations, core.LastAppliedConfigAnnotation)
+	annotations[api.MigratedFromAnnotationKey] = v1alpha2.GroupVersion.String()
+
+	return meta.ObjectMeta{
+		Namespace:   legacy.GetNamespace(),
+		Name:        legacy.GetName(),
+		Labels:      legacy.GetLabels(),
+		Annotations: annotations,
+	}
+}
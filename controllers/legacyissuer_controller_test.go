@@ -0,0 +1,171 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/camptocamp/puppetca-issuer/api/v1alpha2"
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+func newLegacyIssuerReconciler(t *testing.T, objs ...runtime.Object) (*LegacyIssuerReconciler, *record.FakeRecorder) {
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, v1alpha2.AddToScheme, api.AddToScheme} {
+		if err := add(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder := record.NewFakeRecorder(10)
+	return &LegacyIssuerReconciler{
+		Client:   fake.NewFakeClientWithScheme(scheme, objs...),
+		Log:      log.NullLogger{},
+		Recorder: recorder,
+		Kind:     api.PuppetCAIssuerKind,
+	}, recorder
+}
+
+func TestLegacyIssuerMigration(t *testing.T) {
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "puppetca"}
+	legacy := &v1alpha2.PuppetCAIssuer{
+		ObjectMeta: meta.ObjectMeta{
+			Namespace: key.Namespace,
+			Name:      key.Name,
+			Labels:    map[string]string{"app": "puppetca"},
+			Annotations: map[string]string{
+				core.LastAppliedConfigAnnotation: "{}",
+				"example.com/team":               "infra",
+			},
+		},
+		Spec: v1alpha2.PuppetCAIssuerSpec{
+			Provisioner: v1alpha2.PuppetCAProvisioner{Name: "puppetca-credentials"},
+		},
+	}
+	r, recorder := newLegacyIssuerReconciler(t, legacy)
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+	}
+
+	// The issuer is created in the new group
+	reconcile()
+	iss := new(api.PuppetCAIssuer)
+	if err := r.Client.Get(ctx, key, iss); err != nil {
+		t.Fatalf("migrated issuer not created: %v", err)
+	}
+	if iss.Spec.Provisioner.Name != "puppetca-credentials" || iss.Spec.SigningMode != api.SigningModeAuto {
+		t.Errorf("migrated issuer spec = %+v, want the defaulted legacy spec", iss.Spec)
+	}
+	if iss.Labels["app"] != "puppetca" || iss.Annotations["example.com/team"] != "infra" {
+		t.Errorf("migrated issuer metadata = %+v, want the legacy labels and annotations", iss.ObjectMeta)
+	}
+	if _, ok := iss.Annotations[core.LastAppliedConfigAnnotation]; ok {
+		t.Errorf("migrated issuer kept the %s annotation", core.LastAppliedConfigAnnotation)
+	}
+	if got := iss.Annotations[api.MigratedFromAnnotationKey]; got != "certmanager.puppetca/v1alpha2" {
+		t.Errorf("migrated issuer %s annotation = %q, want certmanager.puppetca/v1alpha2", api.MigratedFromAnnotationKey, got)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("%d events fired, want a Migrated event", len(recorder.Events))
+	}
+
+	// Its status is reported on the legacy issuer
+	iss.Status.Conditions = []meta.Condition{{
+		Type:               api.ConditionReady,
+		Status:             meta.ConditionTrue,
+		Reason:             "Verified",
+		Message:            "PuppetCA verified and ready to sign certificates",
+		LastTransitionTime: meta.Now(),
+	}}
+	if err := r.Client.Status().Update(ctx, iss); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if err := r.Client.Get(ctx, key, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if conds := legacy.Status.Conditions; len(conds) != 1 || conds[0].Type != v1alpha2.ConditionReady || conds[0].Status != v1alpha2.ConditionTrue {
+		t.Errorf("legacy issuer conditions = %+v, want Ready", conds)
+	}
+
+	// It follows the spec of the legacy issuer
+	legacy.Spec.SigningMode = v1alpha2.SigningModeManual
+	if err := r.Client.Update(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if err := r.Client.Get(ctx, key, iss); err != nil {
+		t.Fatal(err)
+	}
+	if iss.Spec.SigningMode != api.SigningModeManual {
+		t.Errorf("migrated issuer signing mode = %s, want Manual", iss.Spec.SigningMode)
+	}
+
+	// And is kept when the legacy issuer is deleted
+	if err := r.Client.Delete(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if err := r.Client.Get(ctx, key, iss); err != nil {
+		t.Errorf("migrated issuer deleted along with the legacy issuer: %v", err)
+	}
+}
+
+func TestLegacyIssuerMigrationConflict(t *testing.T) {
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "puppetca"}
+	legacy := &v1alpha2.PuppetCAIssuer{
+		ObjectMeta: meta.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		Spec: v1alpha2.PuppetCAIssuerSpec{
+			Provisioner: v1alpha2.PuppetCAProvisioner{Name: "legacy-credentials"},
+		},
+	}
+	existing := &api.PuppetCAIssuer{
+		ObjectMeta: meta.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		Spec: api.PuppetCAIssuerSpec{
+			Provisioner: api.PuppetCAProvisioner{Name: "puppetca-credentials"},
+		},
+	}
+	r, recorder := newLegacyIssuerReconciler(t, legacy, existing)
+
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	iss := new(api.PuppetCAIssuer)
+	if err := r.Client.Get(ctx, key, iss); err != nil {
+		t.Fatal(err)
+	}
+	if iss.Spec.Provisioner.Name != "puppetca-credentials" {
+		t.Errorf("issuer overwritten by the legacy issuer: %+v", iss.Spec)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("%d events fired, want a MigrationConflict event", len(recorder.Events))
+	}
+}
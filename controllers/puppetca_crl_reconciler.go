@@ -0,0 +1,218 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	"github.com/camptocamp/puppetca-issuer/provisioners"
+	"github.com/go-logr/logr"
+
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// defaultCRLKey is the key under which the CRL is published by default.
+	defaultCRLKey = "ca.crl"
+
+	// defaultCRLRefreshInterval is the interval at which the CRL is
+	// published by default.
+	defaultCRLRefreshInterval = time.Hour
+
+	// crlRetryInterval is the interval at which a failed CRL publication is
+	// retried.
+	crlRetryInterval = time.Minute
+)
+
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update
+
+// PuppetCACRLReconciler publishes the CRL of the Puppet CA behind an issuer
+// into a ConfigMap or Secret.
+type PuppetCACRLReconciler struct {
+	*PuppetCAIssuerReconciler
+	issuer    api.GenericIssuer
+	namespace string
+	logger    logr.Logger
+}
+
+func newPuppetCACRLReconciler(r *PuppetCAIssuerReconciler,
+	iss api.GenericIssuer,
+	namespace string,
+	log logr.Logger) *PuppetCACRLReconciler {
+
+	return &PuppetCACRLReconciler{
+		PuppetCAIssuerReconciler: r,
+		issuer:                   iss,
+		namespace:                namespace,
+		logger:                   log,
+	}
+}
+
+// Sync publishes the CRL if the refresh interval has elapsed since it was
+// last published, and records it in the issuer status. It returns the delay
+// after which Sync should be called again, or zero if the CRL is not
+// published.
+func (r *PuppetCACRLReconciler) Sync(ctx context.Context, p *provisioners.PuppetCAProvisioner) time.Duration {
+	crl := r.issuer.GetSpec().CRL
+	status := r.issuer.GetStatus()
+	if crl == nil {
+		status.CRL = nil
+		return 0
+	}
+
+	interval := defaultCRLRefreshInterval
+	if crl.RefreshInterval != nil && crl.RefreshInterval.Duration > 0 {
+		interval = crl.RefreshInterval.Duration
+	}
+
+	now := r.Clock.Now()
+	if status.CRL != nil && status.CRL.LastSyncTime != nil {
+		if next := status.CRL.LastSyncTime.Add(interval); next.After(now) {
+			return next.Sub(now)
+		}
+	}
+
+	nextUpdate, err := r.publish(ctx, p, crl)
+	if err != nil {
+		r.logger.Error(err, "failed to publish Puppet CA CRL", "kind", crl.Kind, "name", crl.Name)
+		r.Recorder.Eventf(r.issuer, core.EventTypeWarning, "CRLSyncFailed", "Failed to publish Puppet CA CRL: %v", err)
+		return crlRetryInterval
+	}
+
+	lastSync := meta.NewTime(now)
+	status.CRL = &api.CRLStatus{
+		LastSyncTime: &lastSync,
+		NextUpdate:   &nextUpdate,
+	}
+	return interval
+}
+
+// publish fetches the CRL from the Puppet CA and stores it into the
+// configured ConfigMap or Secret. It returns the NextUpdate time of the CRL.
+func (r *PuppetCACRLReconciler) publish(ctx context.Context, p *provisioners.PuppetCAProvisioner, crl *api.CRLPublication) (meta.Time, error) {
+	data, err := p.FetchCRL(ctx)
+	if err != nil {
+		return meta.Time{}, err
+	}
+
+	// The Puppet CA serves the CRL in PEM format
+	der := data
+	if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+		der = block.Bytes
+	}
+	parsed, err := x509.ParseDERCRL(der)
+	if err != nil {
+		return meta.Time{}, fmt.Errorf("failed to parse CRL: %v", err)
+	}
+
+	key := crl.Key
+	if key == "" {
+		key = defaultCRLKey
+	}
+
+	var obj runtime.Object
+	var mutate controllerutil.MutateFn
+	switch crl.Kind {
+	case "Secret":
+		secret := &core.Secret{ObjectMeta: meta.ObjectMeta{Namespace: r.namespace, Name: crl.Name}}
+		obj, mutate = secret, func() error {
+			if secret.Data == nil {
+				secret.Data = map[string][]byte{}
+			}
+			secret.Data[key] = data
+			return r.checkOwner(&secret.ObjectMeta)
+		}
+	case "", "ConfigMap":
+		configMap := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Namespace: r.namespace, Name: crl.Name}}
+		obj, mutate = configMap, func() error {
+			if configMap.Data == nil {
+				configMap.Data = map[string]string{}
+			}
+			configMap.Data[key] = string(data)
+			return r.checkOwner(&configMap.ObjectMeta)
+		}
+	default:
+		return meta.Time{}, fmt.Errorf("unsupported kind %q", crl.Kind)
+	}
+
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, obj, mutate)
+	if err != nil {
+		return meta.Time{}, err
+	}
+	r.logger.V(1).Info("published Puppet CA CRL", "kind", crl.Kind, "name", crl.Name, "result", result)
+
+	return meta.NewTime(parsed.TBSCertList.NextUpdate), nil
+}
+
+// checkOwner makes the issuer own the object the CRL is published into when
+// it is created, and refuses to write into an existing object the issuer does
+// not own. Otherwise, the CRL could overwrite any ConfigMap or Secret, and
+// deleting the issuer would garbage collect it.
+func (r *PuppetCACRLReconciler) checkOwner(obj *meta.ObjectMeta) error {
+	ref := meta.NewControllerRef(r.issuer, api.GroupVersion.WithKind(issuerKind(r.issuer)))
+	if obj.CreationTimestamp.IsZero() {
+		obj.OwnerReferences = []meta.OwnerReference{*ref}
+		return nil
+	}
+	if owner := meta.GetControllerOf(obj); owner == nil || owner.UID != ref.UID {
+		return fmt.Errorf("%s already exists and is not owned by the issuer", obj.Name)
+	}
+	return nil
+}
+
+// validateCRLPublication checks the CRL publication settings of s. The CRL
+// cannot be published into a Secret or ConfigMap the credentials are read
+// from.
+func validateCRLPublication(s api.PuppetCAIssuerSpec) error {
+	crl := s.CRL
+	if crl == nil {
+		return nil
+	}
+
+	kind := crl.Kind
+	switch kind {
+	case "":
+		kind = "ConfigMap"
+	case "ConfigMap", "Secret":
+	default:
+		return fmt.Errorf("spec.crl.kind must be one of ConfigMap or Secret")
+	}
+	if errs := validation.IsDNS1123Subdomain(crl.Name); len(errs) > 0 {
+		return fmt.Errorf("spec.crl.name %q is invalid: %s", crl.Name, strings.Join(errs, ", "))
+	}
+	if crl.Key != "" {
+		if errs := validation.IsConfigMapKey(crl.Key); len(errs) > 0 {
+			return fmt.Errorf("spec.crl.key %q is invalid: %s", crl.Key, strings.Join(errs, ", "))
+		}
+	}
+
+	for _, ref := range credentialRefs(s.Provisioner) {
+		if string(ref.Kind) == kind && ref.Name == crl.Name {
+			return fmt.Errorf("spec.crl cannot target %s %s, which %s reads from", kind, crl.Name, ref.field)
+		}
+	}
+	return nil
+}
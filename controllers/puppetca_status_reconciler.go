@@ -17,9 +17,12 @@ package controllers
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
+	"time"
 
-	api "github.com/camptocamp/puppetca-issuer/api/v1alpha2"
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	"github.com/camptocamp/puppetca-issuer/metrics"
 	"github.com/go-logr/logr"
 
 	core "k8s.io/api/core/v1"
@@ -28,12 +31,12 @@ import (
 
 type PuppetCAStatusReconciler struct {
 	*PuppetCAIssuerReconciler
-	issuer *api.PuppetCAIssuer
+	issuer api.GenericIssuer
 	logger logr.Logger
 }
 
 func newPuppetCAStatusReconciler(r *PuppetCAIssuerReconciler,
-	iss *api.PuppetCAIssuer,
+	iss api.GenericIssuer,
 	log logr.Logger) *PuppetCAStatusReconciler {
 
 	return &PuppetCAStatusReconciler{
@@ -44,27 +47,66 @@ func newPuppetCAStatusReconciler(r *PuppetCAIssuerReconciler,
 }
 
 func (r *PuppetCAStatusReconciler) Update(ctx context.Context,
-	status api.ConditionStatus, reason, message string, args ...interface{}) error {
+	status meta.ConditionStatus, reason, message string, args ...interface{}) error {
 	completeMessage := fmt.Sprintf(message, args...)
-	r.setCondition(status, reason, completeMessage)
+	changed := r.setCondition(api.ConditionReady, status, reason, completeMessage)
+	r.issuer.GetStatus().ObservedGeneration = r.issuer.GetGeneration()
+	key := issuerKey(r.issuer)
+	metrics.SetIssuerReady(key.Kind, key.NamespacedName, status == meta.ConditionTrue)
 
 	// Fire an Event to additionally inform users of the change
-	eventType := core.EventTypeNormal
-	if status == api.ConditionFalse {
-		eventType = core.EventTypeWarning
+	if changed {
+		eventType := core.EventTypeNormal
+		if status == meta.ConditionFalse {
+			eventType = core.EventTypeWarning
+		}
+		r.Recorder.Event(r.issuer, eventType, reason, completeMessage)
 	}
-	r.Recorder.Event(r.issuer, eventType, reason, completeMessage)
 
 	return r.Client.Status().Update(ctx, r.issuer)
 }
 
-func (r *PuppetCAStatusReconciler) UpdateNoError(ctx context.Context, status api.ConditionStatus, reason, message string, args ...interface{}) {
+func (r *PuppetCAStatusReconciler) UpdateNoError(ctx context.Context, status meta.ConditionStatus, reason, message string, args ...interface{}) {
 	if err := r.Update(ctx, status, reason, message, args...); err != nil {
 		r.logger.Error(err, "failed to update", "status", status, "reason", reason)
 	}
 }
 
-// setCondition will set a 'condition' on the given api.PuppetCAIssuer resource.
+// SetClientCertExpiring sets the ClientCertExpiring condition from the
+// expiration of cert, the client certificate of the issuer, which is expiring
+// within warning of it. The condition is saved along with the Ready condition
+// by the next Update, and a Warning event is fired when the certificate starts
+// expiring or expires. It returns when the condition is next due to change, or 0 once
+// the certificate has expired.
+func (r *PuppetCAStatusReconciler) SetClientCertExpiring(cert *x509.Certificate, warning time.Duration) time.Duration {
+	now := r.Clock.Now()
+	expiry := cert.NotAfter.UTC().Format(time.RFC3339)
+
+	var status meta.ConditionStatus
+	var reason, message string
+	var next time.Duration
+	switch {
+	case !now.Before(cert.NotAfter):
+		status, reason = meta.ConditionTrue, "Expired"
+		message = fmt.Sprintf("Client certificate %q expired on %s and must be renewed on the Puppet CA", cert.Subject, expiry)
+	case !now.Before(cert.NotAfter.Add(-warning)):
+		status, reason = meta.ConditionTrue, "Expiring"
+		message = fmt.Sprintf("Client certificate %q expires on %s and must be renewed on the Puppet CA", cert.Subject, expiry)
+		next = cert.NotAfter.Sub(now)
+	default:
+		status, reason = meta.ConditionFalse, "Valid"
+		message = fmt.Sprintf("Client certificate %q is valid until %s", cert.Subject, expiry)
+		next = cert.NotAfter.Add(-warning).Sub(now)
+	}
+
+	changed := r.setCondition(api.ConditionClientCertExpiring, status, reason, message)
+	if changed && status == meta.ConditionTrue {
+		r.Recorder.Event(r.issuer, core.EventTypeWarning, reason, message)
+	}
+	return next
+}
+
+// setCondition will set a 'condition' on the given api.GenericIssuer resource.
 //
 // - If no condition of the same type already exists, the condition will be
 //   inserted with the LastTransitionTime set to the current time.
@@ -73,20 +115,23 @@ func (r *PuppetCAStatusReconciler) UpdateNoError(ctx context.Context, status api
 // - If a condition of the same type and different state already exists, the
 //   condition will be updated and the LastTransitionTime set to the current
 //   time.
-func (r *PuppetCAStatusReconciler) setCondition(status api.ConditionStatus, reason, message string) {
+//
+// It returns true if the status or the reason of the condition changed.
+func (r *PuppetCAStatusReconciler) setCondition(condType string, status meta.ConditionStatus, reason, message string) bool {
 	now := meta.NewTime(r.Clock.Now())
-	c := api.PuppetCAIssuerCondition{
-		Type:               api.ConditionReady,
+	c := meta.Condition{
+		Type:               condType,
 		Status:             status,
+		ObservedGeneration: r.issuer.GetGeneration(),
 		Reason:             reason,
 		Message:            message,
-		LastTransitionTime: &now,
+		LastTransitionTime: now,
 	}
 
 	// Search through existing conditions
-	for idx, cond := range r.issuer.Status.Conditions {
+	for idx, cond := range r.issuer.GetStatus().Conditions {
 		// Skip unrelated conditions
-		if cond.Type != api.ConditionReady {
+		if cond.Type != condType {
 			continue
 		}
 
@@ -99,12 +144,13 @@ func (r *PuppetCAStatusReconciler) setCondition(status api.ConditionStatus, reas
 		}
 
 		// Overwrite the existing condition
-		r.issuer.Status.Conditions[idx] = c
-		return
+		r.issuer.GetStatus().Conditions[idx] = c
+		return cond.Status != status || cond.Reason != reason
 	}
 
 	// If we've not found an existing condition of this type, we simply insert
 	// the new condition into the slice.
-	r.issuer.Status.Conditions = append(r.issuer.Status.Conditions, c)
-	r.logger.Info("setting lastTransitionTime for PuppetCAIssuer condition", "condition", api.ConditionReady, "time", now.Time)
+	r.issuer.GetStatus().Conditions = append(r.issuer.GetStatus().Conditions, c)
+	r.logger.Info("setting lastTransitionTime for PuppetCAIssuer condition", "condition", condType, "time", now.Time)
+	return true
 }
@@ -0,0 +1,125 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+func TestSetClientCertExpiring(t *testing.T) {
+	const warning = 7 * 24 * time.Hour
+	notAfter := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "puppetca-issuer"}, NotAfter: notAfter}
+
+	tests := []struct {
+		name string
+
+		// before is how long before the expiration of cert the condition
+		// is set.
+		before time.Duration
+
+		// repeat sets the condition a second time, an hour later.
+		repeat bool
+
+		wantStatus meta.ConditionStatus
+		wantReason string
+		wantNext   time.Duration
+		wantEvents int
+	}{
+		{
+			name:       "well before the warning window",
+			before:     30 * 24 * time.Hour,
+			wantStatus: meta.ConditionFalse,
+			wantReason: "Valid",
+			wantNext:   23 * 24 * time.Hour,
+		},
+		{
+			name:       "inside the warning window",
+			before:     3 * 24 * time.Hour,
+			wantStatus: meta.ConditionTrue,
+			wantReason: "Expiring",
+			wantNext:   3 * 24 * time.Hour,
+			wantEvents: 1,
+		},
+		{
+			name:       "expired",
+			before:     -time.Hour,
+			wantStatus: meta.ConditionTrue,
+			wantReason: "Expired",
+			wantEvents: 1,
+		},
+		{
+			name:       "inside the warning window, set again",
+			before:     3 * 24 * time.Hour,
+			repeat:     true,
+			wantStatus: meta.ConditionTrue,
+			wantReason: "Expiring",
+			wantNext:   3*24*time.Hour - time.Hour,
+			wantEvents: 1,
+		},
+		{
+			name:       "expired, set again",
+			before:     -time.Hour,
+			repeat:     true,
+			wantStatus: meta.ConditionTrue,
+			wantReason: "Expired",
+			wantEvents: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := clocktesting.NewFakeClock(notAfter.Add(-tt.before))
+			recorder := record.NewFakeRecorder(10)
+			iss := &api.PuppetCAIssuer{}
+			r := newPuppetCAStatusReconciler(&PuppetCAIssuerReconciler{Clock: clock, Recorder: recorder}, iss, log.NullLogger{})
+
+			next := r.SetClientCertExpiring(cert, warning)
+			transition := iss.Status.Conditions[0].LastTransitionTime
+			if tt.repeat {
+				clock.Step(time.Hour)
+				next = r.SetClientCertExpiring(cert, warning)
+			}
+
+			if next != tt.wantNext {
+				t.Errorf("SetClientCertExpiring() = %s, want %s", next, tt.wantNext)
+			}
+			if len(iss.Status.Conditions) != 1 {
+				t.Fatalf("conditions = %+v, want a single condition", iss.Status.Conditions)
+			}
+			cond := iss.Status.Conditions[0]
+			if cond.Type != api.ConditionClientCertExpiring || cond.Status != tt.wantStatus || cond.Reason != tt.wantReason {
+				t.Errorf("condition = %s %s %s, want %s %s %s", cond.Type, cond.Status, cond.Reason,
+					api.ConditionClientCertExpiring, tt.wantStatus, tt.wantReason)
+			}
+			if !cond.LastTransitionTime.Equal(&transition) {
+				t.Errorf("condition LastTransitionTime = %s, want %s", cond.LastTransitionTime, transition)
+			}
+			if len(recorder.Events) != tt.wantEvents {
+				t.Errorf("%d events fired, want %d", len(recorder.Events), tt.wantEvents)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/camptocamp/puppetca-issuer/metrics"
+	"github.com/camptocamp/puppetca-issuer/provisioners"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+// PuppetCAClusterIssuerReconciler reconciles a PuppetCAClusterIssuer object
+type PuppetCAClusterIssuerReconciler struct {
+	*PuppetCAIssuerReconciler
+}
+
+// +kubebuilder:rbac:groups=puppetca.camptocamp.com,resources=puppetcaclusterissuers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=puppetca.camptocamp.com,resources=puppetcaclusterissuers/status,verbs=get;update;patch
+
+func (r *PuppetCAClusterIssuerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := r.context()
+	log := r.Log.WithValues("puppetcaclusterissuer", req.Name)
+
+	iss := new(api.PuppetCAClusterIssuer)
+	if err := r.Client.Get(ctx, req.NamespacedName, iss); err != nil {
+		if apierrors.IsNotFound(err) {
+			key := provisioners.Key{Kind: api.PuppetCAClusterIssuerKind, NamespacedName: req.NamespacedName}
+			provisioners.Delete(key)
+			r.unwatchCredentialFiles(key)
+			metrics.DeleteIssuer(api.PuppetCAClusterIssuerKind, req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "failed to retrieve PuppetCAClusterIssuer resource")
+		return ctrl.Result{}, err
+	}
+
+	return r.reconcileIssuer(ctx, log, iss, r.ClusterResourceNamespace)
+}
+
+func (r *PuppetCAClusterIssuerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := r.setupManagerContext(mgr); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &api.PuppetCAClusterIssuer{}, configMapNameIndexKey, issuerConfigMapNames); err != nil {
+		return err
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&api.PuppetCAClusterIssuer{}).
+		Watches(&source.Kind{Type: &core.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: r.issuersReferencing("ConfigMap", configMapNameIndexKey),
+		}).
+		Watches(r.credentialFilesSource(api.PuppetCAClusterIssuerKind), &handler.EnqueueRequestForObject{})
+	if !r.DisableSecretAccess {
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), &api.PuppetCAClusterIssuer{}, secretNameIndexKey, issuerSecretNames); err != nil {
+			return err
+		}
+		b = b.Watches(&source.Kind{Type: &core.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: r.issuersReferencing("Secret", secretNameIndexKey),
+		})
+	}
+	return b.Complete(r)
+}
+
+// issuersReferencing returns a function mapping a Secret or ConfigMap to a
+// reconcile request for each PuppetCAClusterIssuer referencing it, as found
+// in the given index. Only resources of the cluster resource namespace are
+// considered.
+func (r *PuppetCAClusterIssuerReconciler) issuersReferencing(kind, indexKey string) handler.ToRequestsFunc {
+	return func(o handler.MapObject) []reconcile.Request {
+		if o.Meta.GetNamespace() != r.ClusterResourceNamespace {
+			return nil
+		}
+
+		issuers := new(api.PuppetCAClusterIssuerList)
+		if err := r.Client.List(context.Background(), issuers,
+			client.MatchingFields{indexKey: o.Meta.GetName()}); err != nil {
+			r.Log.Error(err, "failed to list PuppetCAClusterIssuers referencing "+kind, "namespace", o.Meta.GetNamespace(), "name", o.Meta.GetName())
+			return nil
+		}
+
+		requests := make([]reconcile.Request, 0, len(issuers.Items))
+		for _, iss := range issuers.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: iss.Name},
+			})
+		}
+		return requests
+	}
+}
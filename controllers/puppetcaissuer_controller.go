@@ -18,21 +18,34 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
+	"github.com/camptocamp/puppetca-issuer/metrics"
 	"github.com/camptocamp/puppetca-issuer/provisioners"
 
-	api "github.com/camptocamp/puppetca-issuer/api/v1alpha2"
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
 )
 
 // PuppetCAIssuerReconciler reconciles a PuppetCAIssuer object
@@ -41,119 +54,411 @@ type PuppetCAIssuerReconciler struct {
 	Log      logr.Logger
 	Clock    clock.Clock
 	Recorder record.EventRecorder
+	managerContext
+
+	// TransportOptions configures the connections of the Puppet CA clients
+	// created for the issuers.
+	TransportOptions provisioners.TransportOptions
+
+	// FileWatcher reloads the credentials read from files when they change.
+	// Credential files are not reloaded if nil.
+	FileWatcher *CredentialFileWatcher
+
+	// ClusterResourceNamespace is the namespace in which the certname
+	// ledgers of the issuers are stored, along with the Secrets and
+	// ConfigMaps referenced by PuppetCAClusterIssuer resources.
+	ClusterResourceNamespace string
+
+	// DisableSecretAccess rejects the issuers reading their credentials
+	// from Secrets or publishing their CRL into one, and stops watching
+	// Secrets, so that the controller needs no access to them.
+	DisableSecretAccess bool
 }
 
-// +kubebuilder:rbac:groups=certmanager.puppetca,resources=puppetcaissuers,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=certmanager.puppetca,resources=puppetcaissuers/status,verbs=get;update;patch
-// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=puppetca.camptocamp.com,resources=puppetcaissuers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=puppetca.camptocamp.com,resources=puppetcaissuers/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=delete
+
+// Secrets are not covered by the markers above: they are granted by
+// config/rbac/secret_role.yaml, which can be dropped when the controller runs
+// with DisableSecretAccess.
 
 func (r *PuppetCAIssuerReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
+	ctx := r.context()
 	log := r.Log.WithValues("puppetcaissuer", req.NamespacedName)
 
 	iss := new(api.PuppetCAIssuer)
 	if err := r.Client.Get(ctx, req.NamespacedName, iss); err != nil {
+		if apierrors.IsNotFound(err) {
+			key := provisioners.Key{Kind: api.PuppetCAIssuerKind, NamespacedName: req.NamespacedName}
+			provisioners.Delete(key)
+			r.unwatchCredentialFiles(key)
+			metrics.DeleteIssuer(api.PuppetCAIssuerKind, req.NamespacedName)
+			return ctrl.Result{}, deleteCertnameLedger(ctx, r.Client, key, r.ClusterResourceNamespace)
+		}
 		log.Error(err, "failed to retrieve PuppetCAIssuer resource")
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		return ctrl.Result{}, err
 	}
 
+	return r.reconcileIssuer(ctx, log, iss, req.Namespace)
+}
+
+// reconcileIssuer validates the given issuer, loads its Puppet CA credentials
+// from the Secret in secretNamespace and stores the resulting provisioner. It
+// is shared by the PuppetCAIssuer and PuppetCAClusterIssuer reconcilers.
+func (r *PuppetCAIssuerReconciler) reconcileIssuer(ctx context.Context, log logr.Logger,
+	iss api.GenericIssuer, secretNamespace string) (ctrl.Result, error) {
+
+	spec := iss.GetSpec()
+
+	// The provisioner of this issuer is evicted when its spec or credentials
+	// turn out to be invalid, so that no CertificateRequest is signed with
+	// stale credentials. It is kept on transient failures, which would
+	// otherwise make a single failed probe stop all signing.
 	statusReconciler := newPuppetCAStatusReconciler(r, iss, log)
-	if err := validatePuppetCAIssuerSpec(iss.Spec); err != nil {
+	if err := validateIssuer(iss, r.DisableSecretAccess); err != nil {
 		log.Error(err, "failed to validate PuppetCAIssuer resource")
-		statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "Validation", "Failed to validate resource: %v", err)
+		provisioners.Delete(issuerKey(iss))
+		statusReconciler.UpdateNoError(ctx, meta.ConditionFalse, "Validation", "Failed to validate resource: %v", err)
 		return ctrl.Result{}, err
 	}
 
-	// Initialize and store the provisioner
-
-	// Puppet CA url, cert, key, and CA cert are all stored as secrets
-	var secret core.Secret
-	var ok bool
-	var url []byte
-	var cert []byte
-	var key []byte
-	var caCert []byte
+	// Watch the credential files before reading them, so that the issuer
+	// recovers as soon as missing files show up
+	r.watchCredentialFiles(log, issuerKey(iss), credentialFiles(spec.Provisioner))
 
-	secretNamespaceName := types.NamespacedName{
-		Namespace: req.Namespace,
-		Name:      iss.Spec.Provisioner.Name,
-	}
+	// Initialize and store the provisioner
 
-	if err := r.Client.Get(ctx, secretNamespaceName, &secret); err != nil {
-		log.Error(err, "failed to retrieve Puppet CA secrets", "namespace", secretNamespaceName.Namespace, "name", secretNamespaceName.Name)
-		if apierrors.IsNotFound(err) {
-			statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve Puppet CA secrets: %v", err)
+	// Puppet CA url, cert, key, and CA cert are stored in Secrets or
+	// ConfigMaps, unless set in the spec
+	creds, err := loadCredentials(ctx, r.Client, spec.Provisioner, secretNamespace)
+	if err != nil {
+		log.Error(err, "failed to retrieve Puppet CA credentials", "namespace", secretNamespace)
+		if apierrors.IsNotFound(err) || isMissingKey(err) || errors.Is(err, os.ErrNotExist) {
+			provisioners.Delete(issuerKey(iss))
+			statusReconciler.UpdateNoError(ctx, meta.ConditionFalse, "NotFound", "Failed to retrieve Puppet CA credentials: %v", err)
 		} else {
-			statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "Error", "Failed to retrieve Puppet CA secrets: %v", err)
+			statusReconciler.UpdateNoError(ctx, meta.ConditionFalse, "Error", "Failed to retrieve Puppet CA credentials: %v", err)
 		}
 		return ctrl.Result{}, err
 	}
 
-	url, ok = secret.Data[iss.Spec.Provisioner.URLRef.Key]
-	if !ok {
-		err := fmt.Errorf("secret %s does not contain key %s", secret.Name, iss.Spec.Provisioner.URLRef.Key)
-		log.Error(err, "failed to retrieve Puppet CA URL from secret", "namespace", secretNamespaceName.Namespace, "name", secretNamespaceName.Name)
-		statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve Puppet CA URL from secret: %v", err)
+	// Reuse the existing provisioner, and thus its pooled connections, if
+	// the credentials did not change
+	opts := transportOptions(r.TransportOptions, spec.Timeouts)
+	p, ok := provisioners.Load(issuerKey(iss))
+	if ok {
+		err = p.SetCredentials(creds, opts)
+	} else {
+		p, err = provisioners.NewProvisioner(issuerKey(iss), creds, opts, r.Log)
+	}
+	if err != nil {
+		log.Error(err, "failed to initialize Puppet CA client", "urls", creds.URLs)
+		provisioners.Delete(issuerKey(iss))
+		statusReconciler.UpdateNoError(ctx, meta.ConditionFalse, probeFailureReason(err), "Failed to initialize Puppet CA client: %v", err)
 		return ctrl.Result{}, err
 	}
 
-	cert, ok = secret.Data[iss.Spec.Provisioner.CertRef.Key]
-	if !ok {
-		err := fmt.Errorf("secret %s does not contain key %s", secret.Name, iss.Spec.Provisioner.CertRef.Key)
-		log.Error(err, "failed to retrieve Puppet CA certificate from secret", "namespace", secretNamespaceName.Namespace, "name", secretNamespaceName.Name)
-		statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve Puppet CA certificate from secret: %v", err)
+	// Warn before the client certificate expires, as the Puppet CA then
+	// fails every call with a TLS error
+	certRequeueAfter := statusReconciler.SetClientCertExpiring(p.ClientCertificate(), clientCertRenewalWarning(spec))
+
+	err = p.Probe(ctx)
+	setProvisionerStatus(iss.GetStatus(), p)
+	if err != nil {
+		log.Error(err, "failed to contact Puppet CA", "urls", creds.URLs)
+		if !provisioners.IsTransient(err) {
+			provisioners.Delete(issuerKey(iss))
+		} else if r.recentlyContacted(iss) {
+			// Stay Ready through short outages of the Puppet CA, only
+			// reporting the health of its endpoints
+			if err := r.Client.Status().Update(ctx, iss); err != nil {
+				log.Error(err, "failed to update status")
+			}
+			return ctrl.Result{}, err
+		}
+		statusReconciler.UpdateNoError(ctx, meta.ConditionFalse, probeFailureReason(err), "Failed to contact Puppet CA: %v", err)
 		return ctrl.Result{}, err
 	}
 
-	key, ok = secret.Data[iss.Spec.Provisioner.KeyRef.Key]
-	if !ok {
-		err := fmt.Errorf("secret %s does not contain key %s", secret.Name, iss.Spec.Provisioner.KeyRef.Key)
-		log.Error(err, "failed to retrieve Puppet CA key from secret", "namespace", secretNamespaceName.Namespace, "name", secretNamespaceName.Name)
-		statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve Puppet CA key from secret: %v", err)
-		return ctrl.Result{}, err
+	provisioners.Store(issuerKey(iss), p)
+
+	// Publish the CRL of the Puppet CA if requested, and come back when
+	// it is due again
+	requeueAfter := newPuppetCACRLReconciler(r, iss, secretNamespace, log).Sync(ctx, p)
+
+	// Probe the Puppet CA regularly, so that the status reflects its last
+	// contact and the failovers done while signing
+	if requeueAfter == 0 || requeueAfter > statusRefreshInterval {
+		requeueAfter = statusRefreshInterval
 	}
 
-	caCert, ok = secret.Data[iss.Spec.Provisioner.CaCertRef.Key]
-	if !ok {
-		err := fmt.Errorf("secret %s does not contain key %s", secret.Name, iss.Spec.Provisioner.CaCertRef.Key)
-		log.Error(err, "failed to retrieve Puppet CA CA certificate from secret", "namespace", secretNamespaceName.Namespace, "name", secretNamespaceName.Name)
-		statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve Puppet CA CA certificate from secret: %v", err)
-		return ctrl.Result{}, err
+	// Come back when the ClientCertExpiring condition is due to change
+	if certRequeueAfter > 0 && requeueAfter > certRequeueAfter {
+		requeueAfter = certRequeueAfter
 	}
 
-	p := provisioners.NewProvisioner(string(url), string(cert),
-		string(key), string(caCert), r.Log)
+	clientCert := p.ClientCertificate()
+	return ctrl.Result{RequeueAfter: requeueAfter}, statusReconciler.Update(ctx, meta.ConditionTrue, "Verified", "%s verified and ready to sign certificates with client certificate %q expiring on %s",
+		issuerKind(iss), clientCert.Subject, clientCert.NotAfter.UTC().Format(time.RFC3339))
+}
 
-	issNamespaceName := types.NamespacedName{
-		Namespace: req.Namespace,
-		Name:      req.Name,
-	}
+// recentlyContacted returns true if iss is Ready and its Puppet CA answered
+// within probeFailureGracePeriod.
+func (r *PuppetCAIssuerReconciler) recentlyContacted(iss api.GenericIssuer) bool {
+	contact := iss.GetStatus().LastContactTime
+	return PuppetCAIssuerHasCondition(iss, meta.Condition{Type: api.ConditionReady, Status: meta.ConditionTrue}) &&
+		contact != nil && r.Clock.Since(contact.Time) < probeFailureGracePeriod
+}
 
-	provisioners.Store(issNamespaceName, p)
+// watchCredentialFiles makes the FileWatcher reload the credentials of the
+// issuer identified by key when the given files change.
+func (r *PuppetCAIssuerReconciler) watchCredentialFiles(log logr.Logger, key provisioners.Key, paths []string) {
+	if r.FileWatcher == nil {
+		return
+	}
+	if err := r.FileWatcher.Watch(key, paths); err != nil {
+		// The credentials can still be read, they just won't be reloaded
+		log.Error(err, "failed to watch credential files", "paths", paths)
+	}
+}
 
-	return ctrl.Result{}, statusReconciler.Update(ctx, api.ConditionTrue, "Verified", "PuppetCAIssuer verified and ready to sign certificates")
+// unwatchCredentialFiles stops watching the credential files of the deleted
+// issuer identified by key.
+func (r *PuppetCAIssuerReconciler) unwatchCredentialFiles(key provisioners.Key) {
+	if r.FileWatcher != nil {
+		_ = r.FileWatcher.Watch(key, nil)
+	}
 }
 
 func (r *PuppetCAIssuerReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := r.setupManagerContext(mgr); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &api.PuppetCAIssuer{}, configMapNameIndexKey, issuerConfigMapNames); err != nil {
+		return err
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&api.PuppetCAIssuer{}).
-		Complete(r)
+		Watches(&source.Kind{Type: &core.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: r.issuersReferencing("ConfigMap", configMapNameIndexKey),
+		}).
+		Watches(r.credentialFilesSource(api.PuppetCAIssuerKind), &handler.EnqueueRequestForObject{})
+	if !r.DisableSecretAccess {
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), &api.PuppetCAIssuer{}, secretNameIndexKey, issuerSecretNames); err != nil {
+			return err
+		}
+		b = b.Watches(&source.Kind{Type: &core.Secret{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: r.issuersReferencing("Secret", secretNameIndexKey),
+		})
+	}
+	return b.Complete(r)
+}
+
+// credentialFilesSource returns the source of the reconcile requests of the
+// issuers of the given kind whose credential files changed.
+func (r *PuppetCAIssuerReconciler) credentialFilesSource(kind string) source.Source {
+	if r.FileWatcher == nil {
+		return &source.Channel{Source: make(chan event.GenericEvent)}
+	}
+	return r.FileWatcher.Source(kind)
+}
+
+// issuersReferencing returns a function mapping a Secret or ConfigMap to a
+// reconcile request for each PuppetCAIssuer referencing it, as found in the
+// given index.
+func (r *PuppetCAIssuerReconciler) issuersReferencing(kind, indexKey string) handler.ToRequestsFunc {
+	return func(o handler.MapObject) []reconcile.Request {
+		issuers := new(api.PuppetCAIssuerList)
+		if err := r.Client.List(context.Background(), issuers,
+			client.InNamespace(o.Meta.GetNamespace()),
+			client.MatchingFields{indexKey: o.Meta.GetName()}); err != nil {
+			r.Log.Error(err, "failed to list PuppetCAIssuers referencing "+kind, "namespace", o.Meta.GetNamespace(), "name", o.Meta.GetName())
+			return nil
+		}
+
+		requests := make([]reconcile.Request, 0, len(issuers.Items))
+		for _, iss := range issuers.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: iss.Namespace, Name: iss.Name},
+			})
+		}
+		return requests
+	}
+}
+
+// secretNameIndexKey and configMapNameIndexKey are the field indexes of
+// issuers by the names of the Secrets and ConfigMaps holding their Puppet CA
+// credentials.
+const (
+	secretNameIndexKey    = ".spec.provisioner.secretName"
+	configMapNameIndexKey = ".spec.provisioner.configMapName"
+)
+
+// statusRefreshInterval is how often the Puppet CA of an issuer is probed to
+// refresh its status.
+const statusRefreshInterval = 5 * time.Minute
+
+// probeFailureGracePeriod is how long a Ready issuer stays Ready after its
+// last contact with the Puppet CA while probing it fails transiently.
+const probeFailureGracePeriod = 3 * statusRefreshInterval
+
+// defaultClientCertRenewalWarning is how long before the expiration of its
+// client certificate an issuer warns about it by default.
+const defaultClientCertRenewalWarning = 30 * 24 * time.Hour
+
+// setProvisionerStatus reports what p knows of the Puppet CA in status: its
+// endpoints, certificates, version and last contact.
+func setProvisionerStatus(status *api.PuppetCAIssuerStatus, p *provisioners.PuppetCAProvisioner) {
+	setEndpointsStatus(status, p)
+	status.CA = certificateStatus(p.CACertificate())
+	status.ClientCertificate = certificateStatus(p.ClientCertificate())
+	if version := p.ServerVersion(); version != "" {
+		status.ServerVersion = version
+	}
+	if contact := p.LastContactTime(); !contact.IsZero() {
+		t := meta.NewTime(contact)
+		status.LastContactTime = &t
+	}
+}
+
+// certificateStatus describes cert in the status of an issuer.
+func certificateStatus(cert *x509.Certificate) *api.CertificateStatus {
+	if cert == nil {
+		return nil
+	}
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := make([]string, len(sum))
+	for i, b := range sum {
+		fingerprint[i] = fmt.Sprintf("%02X", b)
+	}
+	return &api.CertificateStatus{
+		Subject:     cert.Subject.String(),
+		Fingerprint: strings.Join(fingerprint, ":"),
+		NotAfter:    meta.NewTime(cert.NotAfter),
+	}
+}
+
+// setEndpointsStatus reports the active endpoint of p and the health of each
+// of its endpoints in status.
+func setEndpointsStatus(status *api.PuppetCAIssuerStatus, p *provisioners.PuppetCAProvisioner) {
+	status.ActiveEndpoint = p.ActiveEndpoint()
+	status.Endpoints = nil
+	for _, e := range p.Endpoints() {
+		es := api.EndpointStatus{
+			URL:                 e.URL,
+			Healthy:             e.Healthy,
+			ConsecutiveFailures: e.ConsecutiveFailures,
+			LastError:           e.LastError,
+		}
+		if !e.LastFailureTime.IsZero() {
+			t := meta.NewTime(e.LastFailureTime)
+			es.LastFailureTime = &t
+		}
+		status.Endpoints = append(status.Endpoints, es)
+	}
+}
+
+// clientCertRenewalWarning returns how long before the expiration of its
+// client certificate the issuer warns about it.
+func clientCertRenewalWarning(s *api.PuppetCAIssuerSpec) time.Duration {
+	if s.ClientCertRenewalWarning != nil {
+		return s.ClientCertRenewalWarning.Duration
+	}
+	return defaultClientCertRenewalWarning
+}
+
+// transportOptions returns opts with the timeouts set on the issuer.
+func transportOptions(opts provisioners.TransportOptions, timeouts *api.Timeouts) provisioners.TransportOptions {
+	if timeouts == nil {
+		return opts
+	}
+	if timeouts.Connect != nil {
+		opts.ConnectTimeout = timeouts.Connect.Duration
+	}
+	if timeouts.TLSHandshake != nil {
+		opts.TLSHandshakeTimeout = timeouts.TLSHandshake.Duration
+	}
+	if timeouts.Request != nil {
+		opts.RequestTimeout = timeouts.Request.Duration
+	}
+	return opts
+}
+
+// validateIssuer checks the spec of iss, and that its credential sources are
+// allowed for its kind and by disableSecretAccess. It is shared by the
+// reconcilers and the validating webhook.
+func validateIssuer(iss api.GenericIssuer, disableSecretAccess bool) error {
+	if err := validatePuppetCAIssuerSpec(*iss.GetSpec()); err != nil {
+		return err
+	}
+	if err := validateCredentialSources(iss); err != nil {
+		return err
+	}
+	if disableSecretAccess {
+		return validateNoSecretAccess(*iss.GetSpec())
+	}
+	return nil
 }
 
 func validatePuppetCAIssuerSpec(s api.PuppetCAIssuerSpec) error {
 	switch {
-	case s.Provisioner.Name == "":
-		return fmt.Errorf("spec.provisioner.name cannot be empty")
-	case s.Provisioner.URLRef.Key == "":
-		return fmt.Errorf("spec.provisioner.url.key cannot be empty")
-	case s.Provisioner.CertRef.Key == "":
-		return fmt.Errorf("spec.provisioner.cert.key cannot be empty")
-	case s.Provisioner.KeyRef.Key == "":
-		return fmt.Errorf("spec.provisioner.key.key cannot be empty")
-	case s.Provisioner.CaCertRef.Key == "":
-		return fmt.Errorf("spec.provisioner.cacert.key cannot be empty")
+	case s.SigningMode != "" && s.SigningMode != api.SigningModeAuto && s.SigningMode != api.SigningModeManual:
+		return fmt.Errorf("spec.signingMode must be one of %s or %s", api.SigningModeAuto, api.SigningModeManual)
+	case s.RenewalPolicy != "" && s.RenewalPolicy != api.RenewalPolicyReplace && s.RenewalPolicy != api.RenewalPolicyFail:
+		return fmt.Errorf("spec.renewalPolicy must be one of %s or %s", api.RenewalPolicyReplace, api.RenewalPolicyFail)
+	case s.DeletionPolicy != "" && s.DeletionPolicy != api.DeletionPolicyClean && s.DeletionPolicy != api.DeletionPolicyRevoke && s.DeletionPolicy != api.DeletionPolicyRetain:
+		return fmt.Errorf("spec.deletionPolicy must be one of %s, %s or %s", api.DeletionPolicyClean, api.DeletionPolicyRevoke, api.DeletionPolicyRetain)
+	}
+	if err := validateCredentialRefs(s.Provisioner); err != nil {
+		return err
+	}
+	if err := validateCRLPublication(s); err != nil {
+		return err
+	}
+	if s.ClientCertRenewalWarning != nil && s.ClientCertRenewalWarning.Duration < 0 {
+		return fmt.Errorf("spec.clientCertRenewalWarning cannot be negative")
+	}
+	for i, e := range s.Provisioner.Endpoints {
+		if u, err := url.Parse(e); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("spec.provisioner.endpoints[%d] must be an https URL", i)
+		}
+	}
+	if err := provisioners.ValidateCertnameTemplate(s.CertnameTemplate); err != nil {
+		return fmt.Errorf("spec.certnameTemplate: %v", err)
+	}
+	if err := provisioners.ValidateTrustedFactsPolicy(s.TrustedFacts); err != nil {
+		return fmt.Errorf("spec.trustedFacts: %v", err)
+	}
+	return provisioners.ValidatePolicy(s.Policy)
+}
+
+// probeFailureReason returns the condition reason matching an error returned
+// by PuppetCAProvisioner.Probe.
+func probeFailureReason(err error) string {
+	var httpErr *provisioners.HTTPError
+	switch {
+	case provisioners.IsTLSError(err):
+		return "TLSError"
+	case provisioners.IsUnauthorized(err):
+		return "Unauthorized"
+	case errors.As(err, &httpErr):
+		return "Error"
 	default:
-		return nil
+		return "Unreachable"
+	}
+}
+
+// operationFailureReason returns the reason of a failed certificate operation
+// reported in the metrics. Errors not coming from the Puppet CA, such as an
+// invalid CSR, are reported as Invalid.
+func operationFailureReason(err error) string {
+	var httpErr *provisioners.HTTPError
+	var urlErr *url.Error
+	if !errors.As(err, &httpErr) && !errors.As(err, &urlErr) && !provisioners.IsTLSError(err) {
+		return "Invalid"
 	}
+	return probeFailureReason(err)
 }
@@ -0,0 +1,233 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	core "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+// +kubebuilder:webhook:path=/mutate-puppetca-camptocamp-com-v1beta1-puppetcaissuer,mutating=true,failurePolicy=fail,groups=puppetca.camptocamp.com,resources=puppetcaissuers,verbs=create;update,versions=v1beta1,name=mpuppetcaissuer.puppetca.camptocamp.com
+// +kubebuilder:webhook:path=/mutate-puppetca-camptocamp-com-v1beta1-puppetcaclusterissuer,mutating=true,failurePolicy=fail,groups=puppetca.camptocamp.com,resources=puppetcaclusterissuers,verbs=create;update,versions=v1beta1,name=mpuppetcaclusterissuer.puppetca.camptocamp.com
+
+// PuppetCAIssuerDefaulter sets the defaults of PuppetCAIssuer and
+// PuppetCAClusterIssuer resources on admission, so that stored issuers show
+// the settings in use.
+type PuppetCAIssuerDefaulter struct {
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the webhook with the webhook server of
+// mgr.
+func (d *PuppetCAIssuerDefaulter) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	srv := mgr.GetWebhookServer()
+	srv.Register("/mutate-puppetca-camptocamp-com-v1beta1-puppetcaissuer", &webhook.Admission{Handler: d})
+	srv.Register("/mutate-puppetca-camptocamp-com-v1beta1-puppetcaclusterissuer", &webhook.Admission{Handler: d})
+	return nil
+}
+
+// InjectDecoder implements admission.DecoderInjector.
+func (d *PuppetCAIssuerDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+// Handle sets the defaults of the issuer.
+func (d *PuppetCAIssuerDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var iss api.GenericIssuer
+	switch req.Kind.Kind {
+	case api.PuppetCAIssuerKind:
+		iss = new(api.PuppetCAIssuer)
+	case api.PuppetCAClusterIssuerKind:
+		iss = new(api.PuppetCAClusterIssuer)
+	default:
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("unsupported kind %q", req.Kind.Kind))
+	}
+
+	if err := d.decoder.Decode(req, iss); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	defaultIssuerSpec(iss.GetSpec())
+
+	marshaled, err := json.Marshal(iss)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// defaultIssuerSpec sets the unset fields of s to their defaults. The
+// timeouts are left unset, so that they follow the ones configured on the
+// controller command line.
+func defaultIssuerSpec(s *api.PuppetCAIssuerSpec) {
+	// The names of the references are left empty rather than set to the
+	// secretName, so that changing the secretName still applies to them.
+	// Their keys are left empty too, as the default key of a reference
+	// depends on whether it is later given a name.
+	for _, ref := range credentialRefs(s.Provisioner) {
+		var sel *api.SecretKeySelector
+		switch ref.field {
+		case "spec.provisioner.url":
+			sel = &s.Provisioner.URLRef
+		case "spec.provisioner.cert":
+			sel = &s.Provisioner.CertRef
+		case "spec.provisioner.key":
+			sel = &s.Provisioner.KeyRef
+		case "spec.provisioner.cacert":
+			sel = &s.Provisioner.CaCertRef
+		}
+		sel.Kind = ref.Kind
+		if ref.Kind != api.CredentialSourceFile && sel.Name != "" {
+			sel.Key = ref.Key
+		}
+	}
+
+	if s.SigningMode == "" {
+		s.SigningMode = api.SigningModeAuto
+	}
+	if s.RenewalPolicy == "" {
+		s.RenewalPolicy = api.RenewalPolicyReplace
+	}
+	if s.DeletionPolicy == "" {
+		s.DeletionPolicy = api.DeletionPolicyClean
+	}
+
+	if s.ClientCertRenewalWarning == nil {
+		s.ClientCertRenewalWarning = &metav1.Duration{Duration: defaultClientCertRenewalWarning}
+	}
+
+	if s.CRL != nil {
+		if s.CRL.Kind == "" {
+			s.CRL.Kind = "ConfigMap"
+		}
+		if s.CRL.Key == "" {
+			s.CRL.Key = defaultCRLKey
+		}
+		if s.CRL.RefreshInterval == nil {
+			s.CRL.RefreshInterval = &metav1.Duration{Duration: defaultCRLRefreshInterval}
+		}
+	}
+}
+
+// +kubebuilder:webhook:path=/validate-puppetca-camptocamp-com-v1beta1-puppetcaissuer,mutating=false,failurePolicy=fail,groups=puppetca.camptocamp.com,resources=puppetcaissuers,verbs=create;update,versions=v1beta1,name=vpuppetcaissuer.puppetca.camptocamp.com
+// +kubebuilder:webhook:path=/validate-puppetca-camptocamp-com-v1beta1-puppetcaclusterissuer,mutating=false,failurePolicy=fail,groups=puppetca.camptocamp.com,resources=puppetcaclusterissuers,verbs=create;update,versions=v1beta1,name=vpuppetcaclusterissuer.puppetca.camptocamp.com
+
+// PuppetCAIssuerValidator validates PuppetCAIssuer and PuppetCAClusterIssuer
+// resources on admission, so that invalid issuers are rejected by the API
+// server instead of failing in the reconciler.
+type PuppetCAIssuerValidator struct {
+	Client client.Client
+
+	// ClusterResourceNamespace is the namespace in which the Secrets and
+	// ConfigMaps referenced by PuppetCAClusterIssuer resources are looked up.
+	ClusterResourceNamespace string
+
+	// DisableSecretAccess rejects the issuers using Secrets, so that
+	// neither the webhook nor the controller read them.
+	DisableSecretAccess bool
+
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the webhook with the webhook server of
+// mgr.
+func (v *PuppetCAIssuerValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	srv := mgr.GetWebhookServer()
+	srv.Register("/validate-puppetca-camptocamp-com-v1beta1-puppetcaissuer", &webhook.Admission{Handler: v})
+	srv.Register("/validate-puppetca-camptocamp-com-v1beta1-puppetcaclusterissuer", &webhook.Admission{Handler: v})
+	return nil
+}
+
+// InjectDecoder implements admission.DecoderInjector.
+func (v *PuppetCAIssuerValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle rejects invalid issuers, and warns about the Secrets and ConfigMaps
+// they reference which do not exist yet.
+func (v *PuppetCAIssuerValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var iss api.GenericIssuer
+	namespace := req.Namespace
+	switch req.Kind.Kind {
+	case api.PuppetCAIssuerKind:
+		iss = new(api.PuppetCAIssuer)
+	case api.PuppetCAClusterIssuerKind:
+		iss = new(api.PuppetCAClusterIssuer)
+		namespace = v.ClusterResourceNamespace
+	default:
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("unsupported kind %q", req.Kind.Kind))
+	}
+
+	if err := v.decoder.Decode(req, iss); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if err := validateIssuer(iss, v.DisableSecretAccess); err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	resp := admission.Allowed("")
+	resp.Warnings = v.missingCredentials(ctx, iss, namespace)
+	return resp
+}
+
+// missingCredentials returns a warning for each Secret or ConfigMap
+// referenced by iss which does not exist in namespace. They may legitimately
+// be created after the issuer, which is then not Ready until they are.
+func (v *PuppetCAIssuerValidator) missingCredentials(ctx context.Context, iss api.GenericIssuer, namespace string) []string {
+	var warnings []string
+	checked := make(map[api.SecretKeySelector]bool)
+	for _, ref := range credentialRefs(iss.GetSpec().Provisioner) {
+		var obj runtime.Object
+		switch ref.Kind {
+		case api.CredentialSourceSecret:
+			obj = new(core.Secret)
+		case api.CredentialSourceConfigMap:
+			obj = new(core.ConfigMap)
+		default:
+			continue
+		}
+
+		// Only check each resource once
+		key := api.SecretKeySelector{Kind: ref.Kind, Name: ref.Name}
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+
+		err := v.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, obj)
+		if apierrors.IsNotFound(err) {
+			warnings = append(warnings, fmt.Sprintf("%s %s/%s referenced by %s does not exist yet", ref.Kind, namespace, ref.Name, ref.field))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,301 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+// secret returns a reference to key in the Secret name.
+func secret(name, key string) api.SecretKeySelector {
+	return api.SecretKeySelector{Kind: api.CredentialSourceSecret, Name: name, Key: key}
+}
+
+func TestDefaultIssuerSpec(t *testing.T) {
+	policies := func(s api.PuppetCAIssuerSpec) api.PuppetCAIssuerSpec {
+		s.SigningMode = api.SigningModeAuto
+		s.RenewalPolicy = api.RenewalPolicyReplace
+		s.DeletionPolicy = api.DeletionPolicyClean
+		s.ClientCertRenewalWarning = &metav1.Duration{Duration: defaultClientCertRenewalWarning}
+		return s
+	}
+	tests := []struct {
+		name string
+		spec api.PuppetCAIssuerSpec
+		want api.PuppetCAIssuerSpec
+	}{
+		{
+			name: "secretName leaves the keys unset",
+			spec: api.PuppetCAIssuerSpec{
+				Provisioner: api.PuppetCAProvisioner{Name: "puppetca"},
+			},
+			want: policies(api.PuppetCAIssuerSpec{
+				Provisioner: api.PuppetCAProvisioner{
+					Name:      "puppetca",
+					URLRef:    secret("", ""),
+					CertRef:   secret("", ""),
+					KeyRef:    secret("", ""),
+					CaCertRef: secret("", ""),
+				},
+			}),
+		},
+		{
+			name: "named references use the kubernetes.io/tls keys",
+			spec: api.PuppetCAIssuerSpec{
+				Provisioner: api.PuppetCAProvisioner{
+					Endpoints: []string{"https://puppet:8140"},
+					CABundle:  "-----BEGIN CERTIFICATE-----",
+					CertRef:   api.SecretKeySelector{Name: "client-tls"},
+					KeyRef:    api.SecretKeySelector{Name: "client-tls"},
+				},
+			},
+			want: policies(api.PuppetCAIssuerSpec{
+				Provisioner: api.PuppetCAProvisioner{
+					Endpoints: []string{"https://puppet:8140"},
+					CABundle:  "-----BEGIN CERTIFICATE-----",
+					CertRef:   secret("client-tls", "tls.crt"),
+					KeyRef:    secret("client-tls", "tls.key"),
+				},
+			}),
+		},
+		{
+			name: "set fields are kept",
+			spec: api.PuppetCAIssuerSpec{
+				Provisioner: api.PuppetCAProvisioner{
+					Name:      "puppetca",
+					URLRef:    api.SecretKeySelector{Kind: api.CredentialSourceConfigMap, Name: "puppetca-url", Key: "endpoint"},
+					CertRef:   api.SecretKeySelector{Kind: api.CredentialSourceFile, Path: "/var/run/puppetca/tls.crt"},
+					KeyRef:    api.SecretKeySelector{Key: "tls.key"},
+					CaCertRef: api.SecretKeySelector{Key: "ca.crt"},
+				},
+				SigningMode:              api.SigningModeManual,
+				RenewalPolicy:            api.RenewalPolicyFail,
+				DeletionPolicy:           api.DeletionPolicyRetain,
+				Timeouts:                 &api.Timeouts{Request: &metav1.Duration{Duration: time.Minute}},
+				ClientCertRenewalWarning: &metav1.Duration{Duration: time.Hour},
+			},
+			want: api.PuppetCAIssuerSpec{
+				Provisioner: api.PuppetCAProvisioner{
+					Name:      "puppetca",
+					URLRef:    api.SecretKeySelector{Kind: api.CredentialSourceConfigMap, Name: "puppetca-url", Key: "endpoint"},
+					CertRef:   api.SecretKeySelector{Kind: api.CredentialSourceFile, Path: "/var/run/puppetca/tls.crt"},
+					KeyRef:    secret("", "tls.key"),
+					CaCertRef: secret("", "ca.crt"),
+				},
+				SigningMode:              api.SigningModeManual,
+				RenewalPolicy:            api.RenewalPolicyFail,
+				DeletionPolicy:           api.DeletionPolicyRetain,
+				Timeouts:                 &api.Timeouts{Request: &metav1.Duration{Duration: time.Minute}},
+				ClientCertRenewalWarning: &metav1.Duration{Duration: time.Hour},
+			},
+		},
+		{
+			name: "CRL publication",
+			spec: api.PuppetCAIssuerSpec{
+				Provisioner: api.PuppetCAProvisioner{Name: "puppetca"},
+				CRL:         &api.CRLPublication{Name: "puppetca-crl"},
+			},
+			want: policies(api.PuppetCAIssuerSpec{
+				Provisioner: api.PuppetCAProvisioner{
+					Name:      "puppetca",
+					URLRef:    secret("", ""),
+					CertRef:   secret("", ""),
+					KeyRef:    secret("", ""),
+					CaCertRef: secret("", ""),
+				},
+				CRL: &api.CRLPublication{
+					Kind:            "ConfigMap",
+					Name:            "puppetca-crl",
+					Key:             defaultCRLKey,
+					RefreshInterval: &metav1.Duration{Duration: defaultCRLRefreshInterval},
+				},
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultIssuerSpec(&tt.spec)
+			if !reflect.DeepEqual(tt.spec, tt.want) {
+				t.Errorf("defaultIssuerSpec() = %+v, want %+v", tt.spec, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultIssuerSpecNamedLater(t *testing.T) {
+	s := api.PuppetCAIssuerSpec{
+		Provisioner: api.PuppetCAProvisioner{Name: "puppetca"},
+	}
+	defaultIssuerSpec(&s)
+
+	// Naming the Secret of a defaulted reference switches it to the
+	// kubernetes.io/tls keys
+	s.Provisioner.CertRef.Name = "client-tls"
+	defaultIssuerSpec(&s)
+
+	want := map[string]api.SecretKeySelector{
+		"spec.provisioner.url":    secret("puppetca", "url"),
+		"spec.provisioner.cert":   secret("client-tls", "tls.crt"),
+		"spec.provisioner.key":    secret("puppetca", "key"),
+		"spec.provisioner.cacert": secret("puppetca", "cacert"),
+	}
+	for _, ref := range credentialRefs(s.Provisioner) {
+		if ref.SecretKeySelector != want[ref.field] {
+			t.Errorf("credentialRefs() %s = %+v, want %+v", ref.field, ref.SecretKeySelector, want[ref.field])
+		}
+	}
+}
+
+func TestValidateIssuer(t *testing.T) {
+	valid := api.PuppetCAIssuerSpec{
+		Provisioner: api.PuppetCAProvisioner{Name: "puppetca"},
+	}
+	files := api.PuppetCAIssuerSpec{
+		Provisioner: api.PuppetCAProvisioner{
+			Endpoints: []string{"https://puppet:8140"},
+			CABundle:  "-----BEGIN CERTIFICATE-----",
+			CertRef:   api.SecretKeySelector{Kind: api.CredentialSourceFile, Path: "/var/run/puppetca/tls.crt"},
+			KeyRef:    api.SecretKeySelector{Kind: api.CredentialSourceFile, Path: "/var/run/puppetca/tls.key"},
+		},
+		CRL: &api.CRLPublication{Name: "puppetca-crl"},
+	}
+	with := func(s api.PuppetCAIssuerSpec, f func(*api.PuppetCAIssuerSpec)) api.PuppetCAIssuerSpec {
+		s.Provisioner.Endpoints = append([]string(nil), s.Provisioner.Endpoints...)
+		if s.CRL != nil {
+			crl := *s.CRL
+			s.CRL = &crl
+		}
+		f(&s)
+		return s
+	}
+
+	tests := []struct {
+		name                string
+		spec                api.PuppetCAIssuerSpec
+		cluster             bool
+		disableSecretAccess bool
+		wantErr             bool
+	}{
+		{
+			name: "secretName",
+			spec: valid,
+		},
+		{
+			name:    "files on a cluster issuer",
+			spec:    files,
+			cluster: true,
+		},
+		{
+			name:    "files on a namespaced issuer",
+			spec:    files,
+			wantErr: true,
+		},
+		{
+			name:                "no Secret without Secret access",
+			spec:                files,
+			cluster:             true,
+			disableSecretAccess: true,
+		},
+		{
+			name:                "Secret credentials without Secret access",
+			spec:                valid,
+			disableSecretAccess: true,
+			wantErr:             true,
+		},
+		{
+			name: "Secret CRL without Secret access",
+			spec: with(files, func(s *api.PuppetCAIssuerSpec) {
+				s.CRL.Kind = "Secret"
+			}),
+			cluster:             true,
+			disableSecretAccess: true,
+			wantErr:             true,
+		},
+		{
+			name: "invalid signing mode",
+			spec: with(valid, func(s *api.PuppetCAIssuerSpec) {
+				s.SigningMode = "Sometimes"
+			}),
+			wantErr: true,
+		},
+		{
+			name: "invalid deletion policy",
+			spec: with(valid, func(s *api.PuppetCAIssuerSpec) {
+				s.DeletionPolicy = "Delete"
+			}),
+			wantErr: true,
+		},
+		{
+			name: "plain HTTP endpoint",
+			spec: with(files, func(s *api.PuppetCAIssuerSpec) {
+				s.Provisioner.Endpoints = append(s.Provisioner.Endpoints, "http://puppet:8140")
+			}),
+			cluster: true,
+			wantErr: true,
+		},
+		{
+			name: "CRL published into the credentials Secret",
+			spec: with(valid, func(s *api.PuppetCAIssuerSpec) {
+				s.CRL = &api.CRLPublication{Kind: "Secret", Name: "puppetca"}
+			}),
+			wantErr: true,
+		},
+		{
+			name: "private key in a ConfigMap",
+			spec: with(valid, func(s *api.PuppetCAIssuerSpec) {
+				s.Provisioner.KeyRef = api.SecretKeySelector{Kind: api.CredentialSourceConfigMap, Name: "puppetca"}
+			}),
+			wantErr: true,
+		},
+		{
+			name: "negative client certificate renewal warning",
+			spec: with(valid, func(s *api.PuppetCAIssuerSpec) {
+				s.ClientCertRenewalWarning = &metav1.Duration{Duration: -time.Hour}
+			}),
+			wantErr: true,
+		},
+		{
+			name: "invalid certname template",
+			spec: with(valid, func(s *api.PuppetCAIssuerSpec) {
+				s.CertnameTemplate = "{{ .CommonName"
+			}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var iss api.GenericIssuer = &api.PuppetCAIssuer{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "puppetca"},
+				Spec:       tt.spec,
+			}
+			if tt.cluster {
+				iss = &api.PuppetCAClusterIssuer{
+					ObjectMeta: metav1.ObjectMeta{Name: "puppetca"},
+					Spec:       tt.spec,
+				}
+			}
+			if err := validateIssuer(iss, tt.disableSecretAccess); (err != nil) != tt.wantErr {
+				t.Errorf("validateIssuer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
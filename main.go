@@ -21,6 +21,7 @@ import (
 	"os"
 
 	puppetcav1alpha2 "github.com/camptocamp/puppetca-issuer/api/v1alpha2"
+	puppetcav1beta1 "github.com/camptocamp/puppetca-issuer/api/v1beta1"
 
 	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
 
@@ -32,6 +33,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/camptocamp/puppetca-issuer/controllers"
+	"github.com/camptocamp/puppetca-issuer/provisioners"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -44,6 +46,7 @@ func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
 
 	_ = puppetcav1alpha2.AddToScheme(scheme)
+	_ = puppetcav1beta1.AddToScheme(scheme)
 	_ = certmanager.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
@@ -51,10 +54,36 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var clusterResourceNamespace string
+	var disableApprovedCheck bool
+	var disableSecretAccess bool
+	transportOptions := provisioners.DefaultTransportOptions
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&clusterResourceNamespace, "cluster-resource-namespace", "puppetca-issuer-system",
+		"The namespace in which the Secrets referenced by PuppetCAClusterIssuer resources are looked up, and the certname ledgers of all issuers stored.")
+	flag.BoolVar(&disableApprovedCheck, "disable-approved-check", false,
+		"Sign CertificateRequests without waiting for them to be Approved. "+
+			"Required with cert-manager versions older than 1.3, which do not approve requests.")
+	flag.BoolVar(&disableSecretAccess, "disable-secret-access", false,
+		"Reject the issuers reading their credentials from Secrets or publishing their CRL into one, and do not watch Secrets. "+
+			"The controller then needs no access to Secrets.")
+	flag.DurationVar(&transportOptions.KeepAlive, "puppetca-keep-alive", transportOptions.KeepAlive,
+		"The interval between keep-alive probes of the connections to the Puppet CA.")
+	flag.IntVar(&transportOptions.MaxIdleConns, "puppetca-max-idle-conns", transportOptions.MaxIdleConns,
+		"The maximum number of idle connections kept open to the Puppet CA, per issuer.")
+	flag.IntVar(&transportOptions.MaxIdleConnsPerHost, "puppetca-max-idle-conns-per-host", transportOptions.MaxIdleConnsPerHost,
+		"The maximum number of idle connections kept open to a single Puppet CA host, per issuer.")
+	flag.DurationVar(&transportOptions.IdleConnTimeout, "puppetca-idle-conn-timeout", transportOptions.IdleConnTimeout,
+		"How long idle connections to the Puppet CA are kept open.")
+	flag.DurationVar(&transportOptions.ConnectTimeout, "puppetca-connect-timeout", transportOptions.ConnectTimeout,
+		"The default timeout of the TCP connections to the Puppet CA.")
+	flag.DurationVar(&transportOptions.TLSHandshakeTimeout, "puppetca-tls-handshake-timeout", transportOptions.TLSHandshakeTimeout,
+		"The default timeout of the TLS handshakes with the Puppet CA.")
+	flag.DurationVar(&transportOptions.RequestTimeout, "puppetca-request-timeout", transportOptions.RequestTimeout,
+		"The default timeout of the requests to the Puppet CA.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
@@ -71,20 +100,55 @@ func main() {
 		os.Exit(1)
 	}
 
+	fileWatcher, err := controllers.NewCredentialFileWatcher(ctrl.Log.WithName("credential-files"))
+	if err != nil {
+		setupLog.Error(err, "unable to create credential file watcher")
+		os.Exit(1)
+	}
+	if err = mgr.Add(fileWatcher); err != nil {
+		setupLog.Error(err, "unable to add credential file watcher")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.PuppetCAIssuerReconciler{
 		Client:   mgr.GetClient(),
 		Log:      ctrl.Log.WithName("controllers").WithName("PuppetCAIssuer"),
 		Clock:    clock.RealClock{},
 		Recorder: mgr.GetEventRecorderFor("puppetcaissuer-controller"),
+
+		TransportOptions:         transportOptions,
+		FileWatcher:              fileWatcher,
+		ClusterResourceNamespace: clusterResourceNamespace,
+		DisableSecretAccess:      disableSecretAccess,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PuppetCAIssuer")
 		os.Exit(1)
 	}
 
+	if err = (&controllers.PuppetCAClusterIssuerReconciler{
+		PuppetCAIssuerReconciler: &controllers.PuppetCAIssuerReconciler{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("PuppetCAClusterIssuer"),
+			Clock:    clock.RealClock{},
+			Recorder: mgr.GetEventRecorderFor("puppetcaclusterissuer-controller"),
+
+			TransportOptions:         transportOptions,
+			FileWatcher:              fileWatcher,
+			ClusterResourceNamespace: clusterResourceNamespace,
+			DisableSecretAccess:      disableSecretAccess,
+		},
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PuppetCAClusterIssuer")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.CertificateRequestReconciler{
 		Client:   mgr.GetClient(),
 		Log:      ctrl.Log.WithName("controllers").WithName("CertificateRequest"),
 		Recorder: mgr.GetEventRecorderFor("certificaterequests-controller"),
+
+		ClusterResourceNamespace: clusterResourceNamespace,
+		CheckApprovedCondition:   !disableApprovedCheck,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CertificateRequest")
 		os.Exit(1)
@@ -94,10 +158,43 @@ func main() {
 		Client:   mgr.GetClient(),
 		Log:      ctrl.Log.WithName("controllers").WithName("Certificate"),
 		Recorder: mgr.GetEventRecorderFor("certificate-controller"),
+
+		ClusterResourceNamespace: clusterResourceNamespace,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Certificate")
 		os.Exit(1)
 	}
+
+	// The issuers of the deprecated certmanager.puppetca API group are
+	// migrated to the puppetca.camptocamp.com group
+	for _, kind := range []string{puppetcav1beta1.PuppetCAIssuerKind, puppetcav1beta1.PuppetCAClusterIssuerKind} {
+		if err = (&controllers.LegacyIssuerReconciler{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("Legacy" + kind),
+			Recorder: mgr.GetEventRecorderFor("legacyissuer-controller"),
+			Kind:     kind,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Legacy"+kind)
+			os.Exit(1)
+		}
+	}
+
+	// Webhooks need a serving certificate, which is usually not available
+	// when running the controller locally
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&controllers.PuppetCAIssuerDefaulter{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "PuppetCAIssuerDefaulter")
+			os.Exit(1)
+		}
+		if err = (&controllers.PuppetCAIssuerValidator{
+			Client:                   mgr.GetClient(),
+			ClusterResourceNamespace: clusterResourceNamespace,
+			DisableSecretAccess:      disableSecretAccess,
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "PuppetCAIssuerValidator")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -0,0 +1,183 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics defines the Prometheus metrics of the controller. They are
+// registered with the controller-runtime registry, and thus served on the
+// address given by --metrics-addr.
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const metricsNamespace = "puppetca_issuer"
+
+// Puppet CA calls timed by ObservePuppetCARequest.
+const (
+	OperationSubmit = "submit"
+	OperationSign   = "sign"
+	OperationFetch  = "fetch"
+	OperationDelete = "delete"
+	OperationRevoke = "revoke"
+	OperationStatus = "status"
+)
+
+// Certificate operations counted by RecordSuccess and RecordFailure.
+const (
+	OperationIssue = "issue"
+	OperationClean = "clean"
+)
+
+var issuerLabels = []string{"kind", "namespace", "issuer"}
+
+var (
+	puppetCARequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of the calls to the Puppet CA API.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		append(issuerLabels, "operation"),
+	)
+
+	operationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operations_total",
+			Help:      "Number of certificate operations, by result and reason.",
+		},
+		append(issuerLabels, "operation", "result", "reason"),
+	)
+
+	issuerReady = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "ready",
+			Help:      "Whether the issuer is Ready (1) or not (0).",
+		},
+		issuerLabels,
+	)
+
+	clientCertificateExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "client_certificate_expiration_timestamp_seconds",
+			Help:      "Expiration time of the Puppet CA client certificate of the issuer, in seconds since the epoch.",
+		},
+		issuerLabels,
+	)
+)
+
+func init() {
+	crmetrics.Registry.MustRegister(
+		puppetCARequestDuration,
+		operationsTotal,
+		issuerReady,
+		clientCertificateExpiry,
+	)
+}
+
+// issuerSeries holds the label values of the request_duration_seconds and
+// operations_total series of an issuer beyond the issuer labels, so that
+// DeleteIssuer can remove them all.
+type issuerSeries struct {
+	durations  map[string]bool
+	operations map[[3]string]bool
+}
+
+var (
+	seriesMu sync.Mutex
+	series   = make(map[[3]string]*issuerSeries)
+)
+
+// issuerSeriesOf returns the series of an issuer. seriesMu must be held.
+func issuerSeriesOf(kind string, issuer types.NamespacedName) *issuerSeries {
+	key := [3]string{kind, issuer.Namespace, issuer.Name}
+	s, ok := series[key]
+	if !ok {
+		s = &issuerSeries{durations: map[string]bool{}, operations: map[[3]string]bool{}}
+		series[key] = s
+	}
+	return s
+}
+
+func labels(kind string, issuer types.NamespacedName, extra ...string) []string {
+	return append([]string{kind, issuer.Namespace, issuer.Name}, extra...)
+}
+
+// ObservePuppetCARequest records the latency of a call to the Puppet CA made
+// on behalf of an issuer.
+func ObservePuppetCARequest(kind string, issuer types.NamespacedName, operation string, d time.Duration) {
+	seriesMu.Lock()
+	issuerSeriesOf(kind, issuer).durations[operation] = true
+	seriesMu.Unlock()
+	puppetCARequestDuration.WithLabelValues(labels(kind, issuer, operation)...).Observe(d.Seconds())
+}
+
+// RecordSuccess counts a successful certificate operation.
+func RecordSuccess(kind string, issuer types.NamespacedName, operation, reason string) {
+	recordOperation(kind, issuer, operation, "success", reason)
+}
+
+// RecordFailure counts a failed certificate operation.
+func RecordFailure(kind string, issuer types.NamespacedName, operation, reason string) {
+	recordOperation(kind, issuer, operation, "failure", reason)
+}
+
+func recordOperation(kind string, issuer types.NamespacedName, operation, result, reason string) {
+	seriesMu.Lock()
+	issuerSeriesOf(kind, issuer).operations[[3]string{operation, result, reason}] = true
+	seriesMu.Unlock()
+	operationsTotal.WithLabelValues(labels(kind, issuer, operation, result, reason)...).Inc()
+}
+
+// SetIssuerReady records the readiness of an issuer.
+func SetIssuerReady(kind string, issuer types.NamespacedName, ready bool) {
+	value := 0.0
+	if ready {
+		value = 1
+	}
+	issuerReady.WithLabelValues(labels(kind, issuer)...).Set(value)
+}
+
+// SetClientCertificateExpiry records the expiration time of the client
+// certificate an issuer authenticates to the Puppet CA with.
+func SetClientCertificateExpiry(kind string, issuer types.NamespacedName, notAfter time.Time) {
+	clientCertificateExpiry.WithLabelValues(labels(kind, issuer)...).Set(float64(notAfter.Unix()))
+}
+
+// DeleteIssuer removes the series of a deleted issuer, so that their number
+// does not grow as issuers are created and deleted.
+func DeleteIssuer(kind string, issuer types.NamespacedName) {
+	issuerReady.DeleteLabelValues(labels(kind, issuer)...)
+	clientCertificateExpiry.DeleteLabelValues(labels(kind, issuer)...)
+
+	seriesMu.Lock()
+	defer seriesMu.Unlock()
+	s := issuerSeriesOf(kind, issuer)
+	for operation := range s.durations {
+		puppetCARequestDuration.DeleteLabelValues(labels(kind, issuer, operation)...)
+	}
+	for op := range s.operations {
+		operationsTotal.DeleteLabelValues(labels(kind, issuer, op[0], op[1], op[2])...)
+	}
+	delete(series, [3]string{kind, issuer.Namespace, issuer.Name})
+}
@@ -0,0 +1,57 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestDeleteIssuer(t *testing.T) {
+	deleted := types.NamespacedName{Namespace: "default", Name: "deleted"}
+	kept := types.NamespacedName{Namespace: "default", Name: "kept"}
+
+	for _, issuer := range []types.NamespacedName{deleted, kept} {
+		ObservePuppetCARequest("PuppetCAIssuer", issuer, OperationSubmit, time.Second)
+		ObservePuppetCARequest("PuppetCAIssuer", issuer, OperationStatus, time.Second)
+		RecordSuccess("PuppetCAIssuer", issuer, OperationIssue, "Issued")
+		RecordFailure("PuppetCAIssuer", issuer, OperationClean, "NotOwned")
+		SetIssuerReady("PuppetCAIssuer", issuer, true)
+		SetClientCertificateExpiry("PuppetCAIssuer", issuer, time.Now())
+	}
+
+	DeleteIssuer("PuppetCAIssuer", deleted)
+
+	tests := []struct {
+		name      string
+		collector prometheus.Collector
+		want      int
+	}{
+		{name: "request_duration_seconds", collector: puppetCARequestDuration, want: 2},
+		{name: "operations_total", collector: operationsTotal, want: 2},
+		{name: "ready", collector: issuerReady, want: 1},
+		{name: "client_certificate_expiration_timestamp_seconds", collector: clientCertificateExpiry, want: 1},
+	}
+	for _, tt := range tests {
+		if got := testutil.CollectAndCount(tt.collector); got != tt.want {
+			t.Errorf("%s has %d series after DeleteIssuer(), want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"text/template"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+)
+
+// validCertname matches the certnames accepted by the Puppet CA.
+var validCertname = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// CertnameData is the data available to certname templates.
+type CertnameData struct {
+	// Namespace of the Certificate.
+	Namespace string
+
+	// Name of the Certificate.
+	Name string
+
+	// CommonName of the certificate subject.
+	CommonName string
+
+	// SAN is the first subject alternative name usable as certname, see
+	// firstSAN.
+	SAN string
+}
+
+// ValidateCertnameTemplate returns an error if tmpl is not a valid certname
+// template. The template is executed with empty data so that references to
+// unknown fields are caught too.
+func ValidateCertnameTemplate(tmpl string) error {
+	if tmpl == "" {
+		return nil
+	}
+	t, err := template.New("certname").Parse(tmpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(ioutil.Discard, CertnameData{})
+}
+
+// deriveCertname derives the Puppet certname of a certificate from tmpl.
+// Without a template, the common name is used, or the first usable SAN for
+// certificates without a common name, see firstSAN.
+func deriveCertname(tmpl string, data CertnameData) (string, error) {
+	var name string
+	switch {
+	case tmpl != "":
+		t, err := template.New("certname").Parse(tmpl)
+		if err != nil {
+			return "", fmt.Errorf("invalid certname template: %v", err)
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("failed to render certname template: %v", err)
+		}
+		name = b.String()
+	case data.CommonName != "":
+		name = data.CommonName
+	default:
+		name = data.SAN
+	}
+
+	name = strings.ToLower(name)
+	if name == "" {
+		return "", fmt.Errorf("No common name or subject alternative name usable as certname, IPv6 addresses and URIs cannot be used")
+	}
+	if !validCertname.MatchString(name) {
+		return "", fmt.Errorf("Invalid certname %q, only letters, digits, dots, dashes and underscores are allowed", name)
+	}
+	return name, nil
+}
+
+// CertificateRequestCertname returns the Puppet certname Sign uses for cr.
+func CertificateRequestCertname(cr *certmanager.CertificateRequest, spec *api.PuppetCAIssuerSpec) (string, error) {
+	csr, err := decodeCSR(cr.Spec.Request)
+	if err != nil {
+		return "", err
+	}
+	return deriveCertname(spec.CertnameTemplate, csrCertnameData(cr, csr))
+}
+
+// csrCertnameData returns the certname template data of a certificate
+// request.
+func csrCertnameData(cr *certmanager.CertificateRequest, csr *x509.CertificateRequest) CertnameData {
+	name, ok := cr.Annotations[certmanager.CertificateNameKey]
+	if !ok {
+		name = cr.Name
+	}
+
+	ips := make([]string, 0, len(csr.IPAddresses))
+	for _, ip := range csr.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	uris := make([]string, 0, len(csr.URIs))
+	for _, uri := range csr.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	return CertnameData{
+		Namespace:  cr.Namespace,
+		Name:       name,
+		CommonName: csr.Subject.CommonName,
+		SAN:        firstSAN(csr.DNSNames, ips, uris),
+	}
+}
+
+// firstSAN returns the first DNS name, IP address or URI that is not a
+// loopback name or address, as the CSRs generated by some clients always have
+// those SANs, and that is a valid certname. IPv6 addresses and URIs, which
+// contain colons, are thus never used.
+func firstSAN(dnsNames, ips, uris []string) string {
+	for _, sans := range [][]string{dnsNames, ips, uris} {
+		for _, s := range sans {
+			if s != "localhost" && s != "127.0.0.1" && s != "::1" && validCertname.MatchString(strings.ToLower(s)) {
+				return s
+			}
+		}
+	}
+	return ""
+}
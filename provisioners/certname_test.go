@@ -0,0 +1,122 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import "testing"
+
+func TestDeriveCertname(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		data    CertnameData
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "common name",
+			data: CertnameData{CommonName: "Foo.Example.com", SAN: "bar.example.com"},
+			want: "foo.example.com",
+		},
+		{
+			name: "SAN without common name",
+			data: CertnameData{SAN: "bar.example.com"},
+			want: "bar.example.com",
+		},
+		{
+			name: "template",
+			tmpl: "k8s-{{.Namespace}}-{{.Name}}",
+			data: CertnameData{Namespace: "default", Name: "web", CommonName: "foo.example.com"},
+			want: "k8s-default-web",
+		},
+		{
+			name:    "template with unknown field",
+			tmpl:    "{{.Foo}}",
+			data:    CertnameData{CommonName: "foo.example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid template",
+			tmpl:    "{{.Name",
+			wantErr: true,
+		},
+		{
+			name:    "invalid characters",
+			data:    CertnameData{CommonName: "foo example"},
+			wantErr: true,
+		},
+		{
+			name:    "no name",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := deriveCertname(tt.tmpl, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deriveCertname() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("deriveCertname() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstSAN(t *testing.T) {
+	tests := []struct {
+		name     string
+		dnsNames []string
+		ips      []string
+		uris     []string
+		want     string
+	}{
+		{
+			name:     "DNS name first",
+			dnsNames: []string{"foo.example.com"},
+			ips:      []string{"10.0.0.1"},
+			want:     "foo.example.com",
+		},
+		{
+			name:     "loopback skipped",
+			dnsNames: []string{"localhost"},
+			ips:      []string{"127.0.0.1", "::1", "10.0.0.1"},
+			want:     "10.0.0.1",
+		},
+		{
+			name: "IPv6 address skipped",
+			ips:  []string{"2001:db8::1", "10.0.0.1"},
+			want: "10.0.0.1",
+		},
+		{
+			name: "only IPv6 addresses and URIs",
+			ips:  []string{"2001:db8::1"},
+			uris: []string{"spiffe://cluster.local/ns/default/sa/web"},
+			want: "",
+		},
+		{
+			name:     "invalid DNS name skipped",
+			dnsNames: []string{"*.example.com", "foo.example.com"},
+			want:     "foo.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := firstSAN(tt.dnsNames, tt.ips, tt.uris); got != tt.want {
+				t.Errorf("firstSAN() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
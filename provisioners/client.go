@@ -0,0 +1,477 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// unhealthyThreshold is the number of consecutive failures after which
+	// an endpoint is considered unhealthy.
+	unhealthyThreshold = 3
+
+	// unhealthyRetryInterval is how long an unhealthy endpoint is skipped
+	// before being tried again.
+	unhealthyRetryInterval = time.Minute
+)
+
+// Client is a client for the Puppet CA HTTP API. It replaces go-puppetca,
+// which reports unexpected HTTP responses as plain strings: the probe needs
+// their status codes to tell a Puppet CA rejecting the client certificate
+// from an unreachable one, so they are reported as *HTTPError. go-puppetca
+// can neither be given a transport, a context nor a timeout, which the
+// connection reuse, cancellation and failover built on Client rely on too.
+//
+// A Client can be given several endpoints serving the same Puppet CA. Each
+// request is sent to the first healthy endpoint, and to the next ones in
+// turn when it does not answer, e.g. because of a network or TLS error.
+type Client struct {
+	httpClient     *http.Client
+	requestTimeout time.Duration
+
+	// mu protects the endpoints health and the fields below.
+	mu        sync.Mutex
+	endpoints []*endpoint
+	active    int
+	// serverVersion is the Puppet Server version last reported by an
+	// endpoint.
+	serverVersion string
+	// lastContact is the last time an endpoint answered with an HTTP
+	// response.
+	lastContact time.Time
+}
+
+// endpoint is a Puppet CA URL along with its health.
+type endpoint struct {
+	baseURL     string
+	failures    int
+	lastError   string
+	lastFailure time.Time
+	retryAt     time.Time
+}
+
+// EndpointHealth reports the health of an endpoint of a Client.
+type EndpointHealth struct {
+	URL                 string
+	Healthy             bool
+	ConsecutiveFailures int
+	LastError           string
+	LastFailureTime     time.Time
+}
+
+// HTTPError is returned when the Puppet CA answers with an unexpected status
+// code.
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("failed to %s URL %s, got: %s", e.Method, e.URL, e.Status)
+}
+
+// CertificateStatus is the state of a certname as returned by the
+// certificate_status endpoint.
+type CertificateStatus struct {
+	Name         string `json:"name"`
+	State        string `json:"state"`
+	Fingerprint  string `json:"fingerprint"`
+	SerialNumber int64  `json:"serial_number,omitempty"`
+	NotBefore    string `json:"not_before,omitempty"`
+	NotAfter     string `json:"not_after,omitempty"`
+}
+
+// TransportOptions configures the connections opened to the Puppet CA.
+type TransportOptions struct {
+	// KeepAlive is the interval between TCP keep-alive probes.
+	KeepAlive time.Duration
+
+	// MaxIdleConns is the maximum number of idle connections kept open.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept
+	// open to a single Puppet CA host.
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout is how long an idle connection is kept open.
+	IdleConnTimeout time.Duration
+
+	// ConnectTimeout bounds the establishment of TCP connections.
+	ConnectTimeout time.Duration
+
+	// TLSHandshakeTimeout bounds TLS handshakes.
+	TLSHandshakeTimeout time.Duration
+
+	// RequestTimeout bounds each request, from sending it to reading the
+	// whole response.
+	RequestTimeout time.Duration
+}
+
+// DefaultTransportOptions are the TransportOptions used by the controller
+// unless overridden on the command line.
+var DefaultTransportOptions = TransportOptions{
+	KeepAlive:           30 * time.Second,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+	ConnectTimeout:      10 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	RequestTimeout:      30 * time.Second,
+}
+
+// NewClient returns a new Client for the given ordered endpoints,
+// authenticating with the given PEM encoded certificate and key, and trusting
+// the PEM encoded CA certificate.
+func NewClient(baseURLs []string, keyStr, certStr, caStr string, opts TransportOptions) (*Client, error) {
+	if len(baseURLs) == 0 {
+		return nil, fmt.Errorf("no Puppet CA URL")
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certStr), []byte(keyStr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM([]byte(caStr)) {
+		return nil, fmt.Errorf("failed to load CA certificate: no certificate found")
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      caCertPool,
+	}
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   opts.ConnectTimeout,
+			KeepAlive: opts.KeepAlive,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+	}
+	httpClient := &http.Client{Transport: tr}
+
+	endpoints := make([]*endpoint, 0, len(baseURLs))
+	for _, baseURL := range baseURLs {
+		endpoints = append(endpoints, &endpoint{baseURL: strings.TrimSuffix(baseURL, "/")})
+	}
+
+	return &Client{
+		httpClient:     httpClient,
+		requestTimeout: opts.RequestTimeout,
+		endpoints:      endpoints,
+	}, nil
+}
+
+// ActiveEndpoint returns the URL of the endpoint which last answered, or of
+// the first endpoint if none did yet.
+func (c *Client) ActiveEndpoint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints[c.active].baseURL
+}
+
+// Endpoints returns the health of the endpoints of the client.
+func (c *Client) Endpoints() []EndpointHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	health := make([]EndpointHealth, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		health = append(health, EndpointHealth{
+			URL:                 e.baseURL,
+			Healthy:             e.healthy(now),
+			ConsecutiveFailures: e.failures,
+			LastError:           e.lastError,
+			LastFailureTime:     e.lastFailure,
+		})
+	}
+	return health
+}
+
+// ServerVersion returns the Puppet Server version reported by the endpoints
+// in the X-Puppet-Version header, or an empty string if none did yet.
+func (c *Client) ServerVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverVersion
+}
+
+// LastContactTime returns the last time an endpoint answered, or the zero
+// time if none did yet.
+func (c *Client) LastContactTime() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastContact
+}
+
+// healthy returns true unless the endpoint failed repeatedly and is not due
+// for another try.
+func (e *endpoint) healthy(now time.Time) bool {
+	return e.failures < unhealthyThreshold || !now.Before(e.retryAt)
+}
+
+// CloseIdleConnections closes the idle connections kept open to the Puppet
+// CA. It is called when the client is replaced.
+func (c *Client) CloseIdleConnections() {
+	if tr, ok := c.httpClient.Transport.(*http.Transport); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// GetCertByName returns the certificate of a node by its name
+func (c *Client) GetCertByName(ctx context.Context, nodename string) (string, error) {
+	pem, err := c.Get(ctx, fmt.Sprintf("certificate/%s", nodename), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve certificate %s: %w", nodename, err)
+	}
+	return pem, nil
+}
+
+// GetCRL returns the certificate revocation list of the CA
+func (c *Client) GetCRL(ctx context.Context) (string, error) {
+	crl, err := c.Get(ctx, "certificate_revocation_list/ca", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve CRL: %w", err)
+	}
+	return crl, nil
+}
+
+// GetRequestByName returns the pending certificate request of a node by its
+// name
+func (c *Client) GetRequestByName(ctx context.Context, nodename string) (string, error) {
+	pem, err := c.Get(ctx, fmt.Sprintf("certificate_request/%s", nodename), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve certificate request %s: %w", nodename, err)
+	}
+	return pem, nil
+}
+
+// GetCertificateStatus returns the status of a certname
+func (c *Client) GetCertificateStatus(ctx context.Context, nodename string) (*CertificateStatus, error) {
+	headers := map[string]string{
+		"Accept": "application/json",
+	}
+	body, err := c.Get(ctx, fmt.Sprintf("certificate_status/%s", nodename), headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve certificate status %s: %w", nodename, err)
+	}
+	status := new(CertificateStatus)
+	if err := json.Unmarshal([]byte(body), status); err != nil {
+		return nil, fmt.Errorf("failed to decode certificate status %s: %w", nodename, err)
+	}
+	return status, nil
+}
+
+// DeleteCertByName deletes the certificate of a given node
+func (c *Client) DeleteCertByName(ctx context.Context, nodename string) error {
+	_, err := c.Delete(ctx, fmt.Sprintf("certificate_status/%s", nodename), nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete certificate %s: %w", nodename, err)
+	}
+	return nil
+}
+
+// SubmitRequest submits a CSR
+func (c *Client) SubmitRequest(ctx context.Context, nodename string, pem string) error {
+	headers := map[string]string{
+		"Content-Type": "text/plain",
+	}
+	_, err := c.Put(ctx, fmt.Sprintf("certificate_request/%s", nodename), pem, headers)
+	if err != nil {
+		return fmt.Errorf("failed to submit CSR %s: %w", nodename, err)
+	}
+	return nil
+}
+
+// SignRequest signs a CSR
+func (c *Client) SignRequest(ctx context.Context, nodename string) error {
+	return c.setDesiredState(ctx, nodename, "signed")
+}
+
+// RevokeCert revokes the certificate of a given node
+func (c *Client) RevokeCert(ctx context.Context, nodename string) error {
+	return c.setDesiredState(ctx, nodename, "revoked")
+}
+
+func (c *Client) setDesiredState(ctx context.Context, nodename, state string) error {
+	action := fmt.Sprintf("{\"desired_state\":\"%s\"}", state)
+	headers := map[string]string{
+		"Content-Type": "text/pson",
+	}
+	_, err := c.Put(ctx, fmt.Sprintf("certificate_status/%s", nodename), action, headers)
+	if err != nil {
+		return fmt.Errorf("failed to set state of %s to %s: %w", nodename, state, err)
+	}
+	return nil
+}
+
+// Get performs a GET request
+func (c *Client) Get(ctx context.Context, path string, headers map[string]string) (string, error) {
+	return c.do(ctx, "GET", path, "", headers)
+}
+
+// Put performs a PUT request
+func (c *Client) Put(ctx context.Context, path, data string, headers map[string]string) (string, error) {
+	return c.do(ctx, "PUT", path, data, headers)
+}
+
+// Delete performs a DELETE request
+func (c *Client) Delete(ctx context.Context, path string, headers map[string]string) (string, error) {
+	return c.do(ctx, "DELETE", path, "", headers)
+}
+
+// do sends the request to the healthy endpoints in turn until one of them
+// answers, and then to the unhealthy ones. An endpoint answers when it sends
+// back an HTTP response other than a 5xx or 429. Network and TLS errors, and
+// 5xx or 429 responses, count as failures of the endpoint and cause the
+// request to be sent to the next endpoint.
+func (c *Client) do(ctx context.Context, method, path, data string, headers map[string]string) (string, error) {
+	var err error
+	for _, i := range c.endpointOrder() {
+		var content string
+		content, err = c.doEndpoint(ctx, c.endpoints[i].baseURL, method, path, data, headers)
+		if answered(err) {
+			c.recordSuccess(i)
+			return content, err
+		}
+		if ctx.Err() != nil {
+			// Cancelled by the caller, not the endpoint's fault
+			return "", err
+		}
+		c.recordFailure(i, err)
+	}
+	return "", err
+}
+
+// answered returns true if err, returned by doEndpoint, means that the
+// endpoint sent back a usable HTTP response.
+func answered(err error) bool {
+	var httpErr *HTTPError
+	if err == nil {
+		return true
+	}
+	return errors.As(err, &httpErr) && !IsTransient(err)
+}
+
+// endpointOrder returns the indexes of the healthy endpoints, followed by the
+// unhealthy ones.
+func (c *Client) endpointOrder() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var healthy, unhealthy []int
+	for i, e := range c.endpoints {
+		if e.healthy(now) {
+			healthy = append(healthy, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// recordFailure records a transient failure of endpoint i.
+func (c *Client) recordFailure(i int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.endpoints[i]
+	e.failures++
+	e.lastError = err.Error()
+	e.lastFailure = time.Now()
+	if e.failures >= unhealthyThreshold {
+		e.retryAt = e.lastFailure.Add(unhealthyRetryInterval)
+	}
+}
+
+// recordSuccess records that endpoint i answered, and makes it the active
+// endpoint.
+func (c *Client) recordSuccess(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.endpoints[i].failures = 0
+	c.active = i
+	c.lastContact = time.Now()
+}
+
+// recordServerVersion records the Puppet Server version reported in a
+// response, if any.
+func (c *Client) recordServerVersion(version string) {
+	if version == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serverVersion = version
+}
+
+func (c *Client) doEndpoint(ctx context.Context, baseURL, method, path, data string, headers map[string]string) (string, error) {
+	if c.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+
+	uri := fmt.Sprintf("%s/puppet-ca/v1/%s", baseURL, path)
+	req, err := http.NewRequestWithContext(ctx, method, uri, strings.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create http request for URL %s: %w", uri, err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	c.recordServerVersion(resp.Header.Get("X-Puppet-Version"))
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read body response from %s: %w", uri, err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return "", &HTTPError{
+			Method:     method,
+			URL:        uri,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	return string(content), nil
+}
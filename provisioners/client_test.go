@@ -0,0 +1,213 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestCredentials returns credentials for the given endpoints, with a new
+// client certificate and trusting the certificate of the httptest TLS
+// servers.
+func newTestCredentials(t *testing.T, ca *x509.Certificate, endpoints ...string) Credentials {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "puppetca-issuer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Credentials{
+		URLs:   endpoints,
+		Cert:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:    string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		CACert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+	}
+}
+
+// newTestClient returns a Client for the given endpoints, trusting the
+// certificate of the httptest TLS servers.
+func newTestClient(t *testing.T, ca *x509.Certificate, endpoints ...string) *Client {
+	creds := newTestCredentials(t, ca, endpoints...)
+	c, err := NewClient(creds.URLs, creds.Key, creds.Cert, creds.CACert, TransportOptions{RequestTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestServer returns a TLS server answering every request with code.
+func newTestServer(code int) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Puppet-Version", "7.4.0")
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			w.Write([]byte(`{"name":"web.example.com","state":"signed"}`))
+		}
+	}))
+}
+
+func TestClientFailover(t *testing.T) {
+	ok := newTestServer(http.StatusOK)
+	defer ok.Close()
+	ca := ok.Certificate()
+	serverError := newTestServer(http.StatusServiceUnavailable)
+	defer serverError.Close()
+	notFound := newTestServer(http.StatusNotFound)
+	defer notFound.Close()
+	unauthorized := newTestServer(http.StatusUnauthorized)
+	defer unauthorized.Close()
+
+	// A plain HTTP server behind an https URL fails the TLS handshake
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	plainURL := "https" + plain.URL[len("http"):]
+
+	closed := httptest.NewTLSServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name         string
+		endpoints    []string
+		wantErr      bool
+		wantActive   string
+		wantFailures []int
+	}{
+		{
+			name:         "first endpoint answers",
+			endpoints:    []string{ok.URL, serverError.URL},
+			wantActive:   ok.URL,
+			wantFailures: []int{0, 0},
+		},
+		{
+			name:         "server error fails over",
+			endpoints:    []string{serverError.URL, ok.URL},
+			wantActive:   ok.URL,
+			wantFailures: []int{1, 0},
+		},
+		{
+			name:         "TLS error fails over",
+			endpoints:    []string{plainURL, ok.URL},
+			wantActive:   ok.URL,
+			wantFailures: []int{1, 0},
+		},
+		{
+			name:         "unreachable endpoint fails over",
+			endpoints:    []string{closed.URL, ok.URL},
+			wantActive:   ok.URL,
+			wantFailures: []int{1, 0},
+		},
+		{
+			name:         "not found does not fail over",
+			endpoints:    []string{notFound.URL, ok.URL},
+			wantErr:      true,
+			wantFailures: []int{0, 0},
+		},
+		{
+			name:         "unauthorized does not fail over",
+			endpoints:    []string{unauthorized.URL, ok.URL},
+			wantErr:      true,
+			wantFailures: []int{0, 0},
+		},
+		{
+			name:         "no endpoint answers",
+			endpoints:    []string{closed.URL, plainURL},
+			wantErr:      true,
+			wantFailures: []int{1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, ca, tt.endpoints...)
+			defer c.CloseIdleConnections()
+			status, err := c.GetCertificateStatus(context.Background(), "web.example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetCertificateStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && status.State != "signed" {
+				t.Errorf("GetCertificateStatus() = %+v, want signed", status)
+			}
+			if tt.wantActive != "" && c.ActiveEndpoint() != tt.wantActive {
+				t.Errorf("ActiveEndpoint() = %s, want %s", c.ActiveEndpoint(), tt.wantActive)
+			}
+			for i, e := range c.Endpoints() {
+				if e.ConsecutiveFailures != tt.wantFailures[i] {
+					t.Errorf("Endpoints()[%d].ConsecutiveFailures = %d, want %d", i, e.ConsecutiveFailures, tt.wantFailures[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClientUnhealthyEndpoint(t *testing.T) {
+	failing := newTestServer(http.StatusInternalServerError)
+	defer failing.Close()
+	ok := newTestServer(http.StatusOK)
+	defer ok.Close()
+	c := newTestClient(t, ok.Certificate(), failing.URL, ok.URL)
+	defer c.CloseIdleConnections()
+
+	for i := 0; i < unhealthyThreshold; i++ {
+		if _, err := c.GetCertificateStatus(context.Background(), "web.example.com"); err != nil {
+			t.Fatalf("GetCertificateStatus() error = %v", err)
+		}
+	}
+	health := c.Endpoints()
+	if health[0].Healthy || health[0].ConsecutiveFailures != unhealthyThreshold || health[0].LastError == "" {
+		t.Errorf("Endpoints()[0] = %+v, want unhealthy after %d failures", health[0], unhealthyThreshold)
+	}
+	if !health[1].Healthy {
+		t.Errorf("Endpoints()[1] = %+v, want healthy", health[1])
+	}
+
+	// The unhealthy endpoint is skipped until it is due for another try
+	if order := c.endpointOrder(); order[0] != 1 || order[1] != 0 {
+		t.Errorf("endpointOrder() = %v, want [1 0]", order)
+	}
+	if _, err := c.GetCertificateStatus(context.Background(), "web.example.com"); err != nil {
+		t.Fatalf("GetCertificateStatus() error = %v", err)
+	}
+	if got := c.Endpoints()[0].ConsecutiveFailures; got != unhealthyThreshold {
+		t.Errorf("Endpoints()[0].ConsecutiveFailures = %d, want %d", got, unhealthyThreshold)
+	}
+	if c.ServerVersion() != "7.4.0" || c.LastContactTime().IsZero() {
+		t.Errorf("ServerVersion() = %q, LastContactTime() = %v, want 7.4.0 and a contact", c.ServerVersion(), c.LastContactTime())
+	}
+}
@@ -0,0 +1,179 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// CredentialsError is returned when the Puppet CA client cannot be built
+// from the issuer credentials.
+type CredentialsError struct {
+	Err error
+}
+
+func (e *CredentialsError) Error() string {
+	return "invalid Puppet CA credentials: " + e.Err.Error()
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// PendingError is returned by Sign while a certificate request awaits a
+// manual signature on the Puppet CA.
+type PendingError struct {
+	Certname string
+}
+
+func (e *PendingError) Error() string {
+	return fmt.Sprintf("waiting for a Puppet administrator to sign the certificate request, e.g. with `puppetserver ca sign --certname %s`", e.Certname)
+}
+
+// IsPending returns true if err is a *PendingError.
+func IsPending(err error) bool {
+	var pendingErr *PendingError
+	return errors.As(err, &pendingErr)
+}
+
+// RejectedError is returned by Sign when a certificate request submitted for
+// a manual signature was removed from the Puppet CA without being signed,
+// e.g. by `puppetserver ca clean`.
+type RejectedError struct {
+	Certname    string
+	SubmittedAt string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("the certificate request of %s submitted to the Puppet CA at %s was removed without being signed", e.Certname, e.SubmittedAt)
+}
+
+// IsRejected returns true if err is a *RejectedError.
+func IsRejected(err error) bool {
+	var rejectedErr *RejectedError
+	return errors.As(err, &rejectedErr)
+}
+
+// PolicyError is returned by Sign when a name of the certificate request is
+// not allowed by the issuer policy.
+type PolicyError struct {
+	// Field is the kind of name, e.g. "DNS name".
+	Field string
+	Name  string
+
+	// Pattern is the denied pattern matching Name, or empty if Name does
+	// not match any allowed pattern.
+	Pattern string
+
+	// Detail replaces the default explanation of the violation when set.
+	Detail string
+}
+
+func (e *PolicyError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("%s %q %s", e.Field, e.Name, e.Detail)
+	}
+	if e.Pattern != "" {
+		return fmt.Sprintf("%s %q is denied by the issuer policy pattern %q", e.Field, e.Name, e.Pattern)
+	}
+	return fmt.Sprintf("%s %q is not allowed by the issuer policy", e.Field, e.Name)
+}
+
+// IsDenied returns true if err is a *PolicyError.
+func IsDenied(err error) bool {
+	var policyErr *PolicyError
+	return errors.As(err, &policyErr)
+}
+
+// NotOwnedError is returned by Clean and Revoke when the certificate of
+// certname was not issued for the Certificate being deleted.
+type NotOwnedError struct {
+	Certname string
+}
+
+func (e *NotOwnedError) Error() string {
+	return fmt.Sprintf("the certificate of %s on the Puppet CA was not issued for this Certificate", e.Certname)
+}
+
+// IsNotOwned returns true if err is a *NotOwnedError.
+func IsNotOwned(err error) bool {
+	var notOwnedErr *NotOwnedError
+	return errors.As(err, &notOwnedErr)
+}
+
+// IsTLSError returns true if err was caused by invalid TLS material or by a
+// failed TLS handshake with the Puppet CA.
+func IsTLSError(err error) bool {
+	var credsErr *CredentialsError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordHeaderErr tls.RecordHeaderError
+	var opErr *net.OpError
+
+	switch {
+	case errors.As(err, &credsErr),
+		errors.As(err, &unknownAuthorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr),
+		errors.As(err, &recordHeaderErr):
+		return true
+	case errors.As(err, &opErr):
+		// TLS alerts sent by the server, e.g. when it rejects our client
+		// certificate, are reported as a "remote error".
+		return opErr.Op == "remote error"
+	default:
+		return false
+	}
+}
+
+// IsUnauthorized returns true if the Puppet CA rejected the request because
+// the client is not authenticated or not allowed to perform it.
+func IsUnauthorized(err error) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden
+}
+
+// IsTransient returns true if err is likely to go away when retried: network
+// errors, and 5xx or 429 answers of the Puppet CA. Other errors, such as 4xx
+// answers, TLS failures or invalid certificate requests, are permanent, and so
+// are cancellations, e.g. when the controller shuts down.
+func IsTransient(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= http.StatusInternalServerError || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	if IsTLSError(err) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// IsNotFound returns true if the Puppet CA answered with a 404.
+func IsNotFound(err error) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound
+}
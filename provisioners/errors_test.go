@@ -0,0 +1,143 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestErrorClassification(t *testing.T) {
+	httpErr := func(code int) error {
+		return fmt.Errorf("Failed to sign CSR on Puppet CA: %w",
+			&HTTPError{Method: "PUT", URL: "https://puppet:8140", StatusCode: code, Status: http.StatusText(code)})
+	}
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://puppet:8140", Err: err}
+	}
+
+	tests := []struct {
+		name             string
+		err              error
+		wantTransient    bool
+		wantTLS          bool
+		wantUnauthorized bool
+	}{
+		{
+			name:          "internal server error",
+			err:           httpErr(http.StatusInternalServerError),
+			wantTransient: true,
+		},
+		{
+			name:          "service unavailable",
+			err:           httpErr(http.StatusServiceUnavailable),
+			wantTransient: true,
+		},
+		{
+			name:          "too many requests",
+			err:           httpErr(http.StatusTooManyRequests),
+			wantTransient: true,
+		},
+		{
+			name: "not found",
+			err:  httpErr(http.StatusNotFound),
+		},
+		{
+			name:             "unauthorized",
+			err:              httpErr(http.StatusUnauthorized),
+			wantUnauthorized: true,
+		},
+		{
+			name:             "forbidden",
+			err:              httpErr(http.StatusForbidden),
+			wantUnauthorized: true,
+		},
+		{
+			name:          "connection refused",
+			err:           urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}),
+			wantTransient: true,
+		},
+		{
+			name:          "DNS failure",
+			err:           urlErr(&net.DNSError{Err: "no such host", Name: "puppet", IsNotFound: true}),
+			wantTransient: true,
+		},
+		{
+			name:          "request timeout",
+			err:           urlErr(context.DeadlineExceeded),
+			wantTransient: true,
+		},
+		{
+			name: "cancelled",
+			err:  urlErr(context.Canceled),
+		},
+		{
+			name:    "unknown authority",
+			err:     urlErr(x509.UnknownAuthorityError{}),
+			wantTLS: true,
+		},
+		{
+			name:    "hostname mismatch",
+			err:     urlErr(x509.HostnameError{Host: "puppet"}),
+			wantTLS: true,
+		},
+		{
+			name:    "expired certificate",
+			err:     urlErr(x509.CertificateInvalidError{Reason: x509.Expired}),
+			wantTLS: true,
+		},
+		{
+			name:    "plain HTTP endpoint",
+			err:     urlErr(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}),
+			wantTLS: true,
+		},
+		{
+			name:    "client certificate rejected",
+			err:     urlErr(&net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}),
+			wantTLS: true,
+		},
+		{
+			name:    "invalid credentials",
+			err:     &CredentialsError{Err: errors.New("tls: failed to find any PEM data in certificate input")},
+			wantTLS: true,
+		},
+		{
+			name: "invalid request",
+			err:  errors.New("No common name specified"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.wantTransient {
+				t.Errorf("IsTransient() = %v, want %v", got, tt.wantTransient)
+			}
+			if got := IsTLSError(tt.err); got != tt.wantTLS {
+				t.Errorf("IsTLSError() = %v, want %v", got, tt.wantTLS)
+			}
+			if got := IsUnauthorized(tt.err); got != tt.wantUnauthorized {
+				t.Errorf("IsUnauthorized() = %v, want %v", got, tt.wantUnauthorized)
+			}
+		})
+	}
+}
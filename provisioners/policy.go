@@ -0,0 +1,139 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"crypto/x509"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+// ValidatePolicy returns an error if a pattern of policy is not a valid glob
+// or regular expression.
+func ValidatePolicy(policy *api.CertificatePolicy) error {
+	if policy == nil {
+		return nil
+	}
+	for _, f := range []struct {
+		field string
+		np    *api.NamePolicy
+	}{
+		{"commonName", policy.CommonName},
+		{"dnsNames", policy.DNSNames},
+		{"ipAddresses", policy.IPAddresses},
+		{"uris", policy.URIs},
+	} {
+		if f.np == nil {
+			continue
+		}
+		for _, pattern := range append(append([]string{}, f.np.Allowed...), f.np.Denied...) {
+			if _, err := matchPattern(pattern, ""); err != nil {
+				return fmt.Errorf("spec.policy.%s: %v", f.field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkPolicy returns a *PolicyError for the first name of csr violating
+// policy.
+func checkPolicy(policy *api.CertificatePolicy, csr *x509.CertificateRequest) error {
+	if policy == nil {
+		return nil
+	}
+
+	if csr.Subject.CommonName != "" {
+		if err := checkNames(policy.CommonName, "common name", csr.Subject.CommonName); err != nil {
+			return err
+		}
+	}
+	if err := checkNames(policy.DNSNames, "DNS name", csr.DNSNames...); err != nil {
+		return err
+	}
+	ips := make([]string, 0, len(csr.IPAddresses))
+	for _, ip := range csr.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	if err := checkNames(policy.IPAddresses, "IP address", ips...); err != nil {
+		return err
+	}
+	uris := make([]string, 0, len(csr.URIs))
+	for _, uri := range csr.URIs {
+		uris = append(uris, uri.String())
+	}
+	return checkNames(policy.URIs, "URI", uris...)
+}
+
+// checkNames returns a *PolicyError for the first name matching a denied
+// pattern of np, or not matching any of its allowed patterns.
+func checkNames(np *api.NamePolicy, field string, names ...string) error {
+	if np == nil {
+		return nil
+	}
+
+	for _, name := range names {
+		for _, pattern := range np.Denied {
+			matched, err := matchPattern(pattern, name)
+			if err != nil {
+				return err
+			}
+			if matched {
+				return &PolicyError{Field: field, Name: name, Pattern: pattern}
+			}
+		}
+
+		if len(np.Allowed) == 0 {
+			continue
+		}
+		allowed := false
+		for _, pattern := range np.Allowed {
+			matched, err := matchPattern(pattern, name)
+			if err != nil {
+				return err
+			}
+			if matched {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &PolicyError{Field: field, Name: name}
+		}
+	}
+	return nil
+}
+
+// matchPattern reports whether name matches pattern, which is a regular
+// expression if enclosed in slashes, and a glob otherwise.
+func matchPattern(pattern, name string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, fmt.Errorf("invalid regular expression %q: %v", pattern, err)
+		}
+		return re.MatchString(name), nil
+	}
+
+	matched, err := path.Match(pattern, name)
+	if err != nil {
+		return false, fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+	return matched, nil
+}
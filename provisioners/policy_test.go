@@ -0,0 +1,190 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+		wantErr bool
+	}{
+		{pattern: "*.example.com", name: "web.example.com", want: true},
+		{pattern: "*.example.com", name: "example.com", want: false},
+		{pattern: "*.example.com", name: "a.web.example.com", want: true},
+		{pattern: "10.0.0.*", name: "10.0.0.1", want: true},
+		{pattern: `/^web[0-9]+\.example\.com$/`, name: "web1.example.com", want: true},
+		{pattern: `/^web[0-9]+\.example\.com$/`, name: "db1.example.com", want: false},
+		{pattern: "/", name: "/", want: true},
+		{pattern: "/web[/", wantErr: true},
+		{pattern: "web[", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			got, err := matchPattern(tt.pattern, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("matchPattern() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("matchPattern() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *api.CertificatePolicy
+		wantErr bool
+	}{
+		{
+			name: "no policy",
+		},
+		{
+			name: "valid patterns",
+			policy: &api.CertificatePolicy{
+				CommonName: &api.NamePolicy{Allowed: []string{"*.example.com"}},
+				DNSNames:   &api.NamePolicy{Denied: []string{`/^admin\./`}},
+			},
+		},
+		{
+			name: "invalid allowed regular expression",
+			policy: &api.CertificatePolicy{
+				URIs: &api.NamePolicy{Allowed: []string{"/(/"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid denied glob",
+			policy: &api.CertificatePolicy{
+				IPAddresses: &api.NamePolicy{Denied: []string{"10.0.0.["}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidatePolicy(tt.policy); (err != nil) != tt.wantErr {
+				t.Errorf("ValidatePolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	policy := &api.CertificatePolicy{
+		CommonName:  &api.NamePolicy{Allowed: []string{"*.example.com"}},
+		DNSNames:    &api.NamePolicy{Allowed: []string{"*.example.com"}, Denied: []string{"admin.example.com"}},
+		IPAddresses: &api.NamePolicy{Allowed: []string{"10.0.0.*"}},
+		URIs:        &api.NamePolicy{Denied: []string{"/^spiffe:/"}},
+	}
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/default/sa/web")
+	https, _ := url.Parse("https://web.example.com")
+
+	tests := []struct {
+		name      string
+		policy    *api.CertificatePolicy
+		csr       *x509.CertificateRequest
+		wantField string
+		wantName  string
+	}{
+		{
+			name: "no policy",
+			csr:  &x509.CertificateRequest{Subject: pkix.Name{CommonName: "anything"}},
+		},
+		{
+			name:   "allowed",
+			policy: policy,
+			csr: &x509.CertificateRequest{
+				Subject:     pkix.Name{CommonName: "web.example.com"},
+				DNSNames:    []string{"web.example.com"},
+				IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+				URIs:        []*url.URL{https},
+			},
+		},
+		{
+			name:   "empty common name is not checked",
+			policy: policy,
+			csr:    &x509.CertificateRequest{DNSNames: []string{"web.example.com"}},
+		},
+		{
+			name:      "common name not allowed",
+			policy:    policy,
+			csr:       &x509.CertificateRequest{Subject: pkix.Name{CommonName: "web.example.org"}},
+			wantField: "common name",
+			wantName:  "web.example.org",
+		},
+		{
+			name:   "denied DNS name",
+			policy: policy,
+			csr: &x509.CertificateRequest{
+				DNSNames: []string{"web.example.com", "admin.example.com"},
+			},
+			wantField: "DNS name",
+			wantName:  "admin.example.com",
+		},
+		{
+			name:   "IP address not allowed",
+			policy: policy,
+			csr: &x509.CertificateRequest{
+				IPAddresses: []net.IP{net.ParseIP("192.168.0.1")},
+			},
+			wantField: "IP address",
+			wantName:  "192.168.0.1",
+		},
+		{
+			name:   "denied URI",
+			policy: policy,
+			csr: &x509.CertificateRequest{
+				URIs: []*url.URL{spiffe},
+			},
+			wantField: "URI",
+			wantName:  spiffe.String(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPolicy(tt.policy, tt.csr)
+			if tt.wantField == "" {
+				if err != nil {
+					t.Errorf("checkPolicy() error = %v, want nil", err)
+				}
+				return
+			}
+			policyErr, ok := err.(*PolicyError)
+			if !ok {
+				t.Fatalf("checkPolicy() error = %v, want *PolicyError", err)
+			}
+			if policyErr.Field != tt.wantField || policyErr.Name != tt.wantName {
+				t.Errorf("checkPolicy() denied %s %q, want %s %q", policyErr.Field, policyErr.Name, tt.wantField, tt.wantName)
+			}
+			if !IsDenied(err) {
+				t.Errorf("IsDenied(%v) = false, want true", err)
+			}
+		})
+	}
+}
@@ -16,13 +16,17 @@ limitations under the License.
 package provisioners
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"sync"
+	"time"
 
-	"github.com/camptocamp/go-puppetca/puppetca"
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	"github.com/camptocamp/puppetca-issuer/metrics"
 	"github.com/go-logr/logr"
 	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -38,24 +42,173 @@ type PuppetCA struct {
 }
 
 type PuppetCAProvisioner struct {
-	url    string
-	cert   string
-	key    string
-	caCert string
-	Log    logr.Logger
+	Log logr.Logger
+	key Key
+
+	// mu protects the fields below, which are replaced as a whole when the
+	// credentials or transport options change.
+	mu         sync.RWMutex
+	creds      Credentials
+	opts       TransportOptions
+	client     *Client
+	clientCert *x509.Certificate
+	caCert     *x509.Certificate
+	certname   string
+}
+
+// Credentials holds the settings used to connect to the Puppet CA.
+type Credentials struct {
+	// URLs are the endpoints of the Puppet CA, in order of preference.
+	URLs   []string
+	Cert   string
+	Key    string
+	CACert string
+}
+
+// equal returns true if c and o are the same credentials.
+func (c Credentials) equal(o Credentials) bool {
+	if len(c.URLs) != len(o.URLs) {
+		return false
+	}
+	for i := range c.URLs {
+		if c.URLs[i] != o.URLs[i] {
+			return false
+		}
+	}
+	return c.Cert == o.Cert && c.Key == o.Key && c.CACert == o.CACert
+}
+
+// NewProvisioner returns a provisioner for the issuer identified by key, with
+// a Puppet CA client built from creds and opts. The client is kept for the
+// lifetime of the provisioner, so that connections to the Puppet CA are reused
+// across operations.
+func NewProvisioner(key Key, creds Credentials, opts TransportOptions, logger logr.Logger) (*PuppetCAProvisioner, error) {
+	p := &PuppetCAProvisioner{
+		Log: logger,
+		key: key,
+	}
+	if err := p.SetCredentials(creds, opts); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
-func NewProvisioner(url string,
-	cert string, key string, caCert string, logger logr.Logger) (p *PuppetCAProvisioner) {
+// SetCredentials replaces the Puppet CA client of the provisioner if creds or
+// opts differ from the ones it currently uses. Otherwise, the existing client
+// and its pooled connections are kept.
+func (p *PuppetCAProvisioner) SetCredentials(creds Credentials, opts TransportOptions) error {
+	p.mu.RLock()
+	unchanged := p.client != nil && p.creds.equal(creds) && p.opts == opts
+	p.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	keyPair, err := tls.X509KeyPair([]byte(creds.Cert), []byte(creds.Key))
+	if err != nil {
+		return &CredentialsError{Err: err}
+	}
+	clientCert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return &CredentialsError{Err: err}
+	}
+
+	// The CA bundle starts with the certificate of the signing CA
+	caCert, err := decodeCertificate([]byte(creds.CACert))
+	if err != nil {
+		return &CredentialsError{Err: fmt.Errorf("failed to load CA certificate: %w", err)}
+	}
 
-	return &PuppetCAProvisioner{
-		url: url, cert: cert, key: key, caCert: caCert, Log: logger,
+	client, err := NewClient(creds.URLs, creds.Key, creds.Cert, creds.CACert, opts)
+	if err != nil {
+		return &CredentialsError{Err: err}
 	}
+
+	p.Log.Info("Creating new Puppet CA client", "urls", creds.URLs)
+	p.mu.Lock()
+	old := p.client
+	p.creds = creds
+	p.opts = opts
+	p.client = client
+	p.clientCert = clientCert
+	p.caCert = caCert
+	p.certname = clientCert.Subject.CommonName
+	p.mu.Unlock()
+	metrics.SetClientCertificateExpiry(p.key.Kind, p.key.NamespacedName, clientCert.NotAfter)
+
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+// getClient returns the current Puppet CA client and the credentials it
+// was built from.
+func (p *PuppetCAProvisioner) getClient() (*Client, Credentials) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.client, p.creds
+}
+
+// ClientCertificate returns the certificate the provisioner authenticates
+// with on the Puppet CA.
+func (p *PuppetCAProvisioner) ClientCertificate() *x509.Certificate {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.clientCert
+}
+
+// CACertificate returns the certificate of the Puppet CA, i.e. the first
+// certificate of the CA bundle.
+func (p *PuppetCAProvisioner) CACertificate() *x509.Certificate {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.caCert
+}
+
+// ServerVersion returns the version of Puppet Server reported by the Puppet
+// CA, or an empty string if it is not known yet.
+func (p *PuppetCAProvisioner) ServerVersion() string {
+	client, _ := p.getClient()
+	return client.ServerVersion()
+}
+
+// LastContactTime returns the last time the Puppet CA answered, or the zero
+// time if it did not yet.
+func (p *PuppetCAProvisioner) LastContactTime() time.Time {
+	client, _ := p.getClient()
+	return client.LastContactTime()
 }
 
-// Load returns a Step provisioner by NamespacedName.
-func Load(namespacedName types.NamespacedName) (*PuppetCAProvisioner, bool) {
-	v, ok := collection.Load(namespacedName)
+// ActiveEndpoint returns the URL of the Puppet CA endpoint currently in use.
+func (p *PuppetCAProvisioner) ActiveEndpoint() string {
+	client, _ := p.getClient()
+	return client.ActiveEndpoint()
+}
+
+// Endpoints returns the health of the Puppet CA endpoints.
+func (p *PuppetCAProvisioner) Endpoints() []EndpointHealth {
+	client, _ := p.getClient()
+	return client.Endpoints()
+}
+
+// observe records the latency of a Puppet CA call made for operation, which
+// started at start.
+func (p *PuppetCAProvisioner) observe(operation string, start time.Time) {
+	metrics.ObservePuppetCARequest(p.key.Kind, p.key.NamespacedName, operation, time.Since(start))
+}
+
+// Key identifies a provisioner in the collection. The Kind of the issuer is
+// part of the key so that a PuppetCAClusterIssuer never shadows a
+// PuppetCAIssuer, or the other way around.
+type Key struct {
+	Kind string
+	types.NamespacedName
+}
+
+// Load returns a Puppet CA provisioner by Key.
+func Load(key Key) (*PuppetCAProvisioner, bool) {
+	v, ok := collection.Load(key)
 	if !ok {
 		return nil, ok
 	}
@@ -63,79 +216,330 @@ func Load(namespacedName types.NamespacedName) (*PuppetCAProvisioner, bool) {
 	return p, ok
 }
 
-// Store adds a new provisioner to the collection by NamespacedName.
-func Store(namespacedName types.NamespacedName, provisioner *PuppetCAProvisioner) {
-	collection.Store(namespacedName, provisioner)
+// Store adds a new provisioner to the collection by Key.
+func Store(key Key, provisioner *PuppetCAProvisioner) {
+	collection.Store(key, provisioner)
+}
+
+// Delete removes a provisioner from the collection by Key.
+func Delete(key Key) {
+	collection.Delete(key)
 }
 
-// Sign sends the certificate requests to the Step CA and returns the signed
-// certificate.
-func (p *PuppetCAProvisioner) Sign(ctx context.Context, cr *certmanager.CertificateRequest) ([]byte, []byte, error) {
+// Probe checks that the Puppet CA is reachable and that the provisioner
+// credentials are allowed to manage certificates, by fetching the certificate
+// status of the client certificate.
+func (p *PuppetCAProvisioner) Probe(ctx context.Context) error {
+	p.mu.RLock()
+	client, certname := p.client, p.certname
+	p.mu.RUnlock()
+
+	// A 404 still proves that the request went through authorization
+	if _, err := p.getStatus(ctx, client, certname); err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// FetchCRL returns the PEM encoded certificate revocation list of the Puppet
+// CA.
+func (p *PuppetCAProvisioner) FetchCRL(ctx context.Context) ([]byte, error) {
+	client, _ := p.getClient()
+	defer p.observe(metrics.OperationFetch, time.Now())
+	crl, err := client.GetCRL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(crl), nil
+}
+
+// OwnerFunc reports whether cert, an existing certificate of certname on the
+// Puppet CA, was issued for the resource being signed or deleted, and may
+// thus be replaced, cleaned or revoked. cert is nil if certname only has a
+// pending request.
+type OwnerFunc func(certname string, cert *x509.Certificate) (bool, error)
+
+// Sign sends the certificate requests to the Puppet CA and returns the signed
+// certificate, followed by any intermediate CA, and the CA bundle. With the
+// Manual signing mode, a *PendingError is returned until a Puppet
+// administrator has signed the request, and a *RejectedError if the request
+// cr records as submitted is no longer known to the Puppet CA.
+//
+// When a certificate already exists for the certname, which is the case when
+// a Certificate is renewed, it is revoked and cleaned before the new request
+// is submitted, provided that the issuer renewal policy allows it and that
+// owner confirms that it belongs to the resource being signed.
+func (p *PuppetCAProvisioner) Sign(ctx context.Context, cr *certmanager.CertificateRequest, spec *api.PuppetCAIssuerSpec, owner OwnerFunc) ([]byte, []byte, error) {
 	// decode and check certificate request
 	csr, err := decodeCSR(cr.Spec.Request)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	subject := csr.Subject.CommonName
-	if subject == "" {
-		return nil, nil, fmt.Errorf("No common name specified")
+	// Enforce the issuer policy before anything reaches the Puppet CA
+	if err := checkPolicy(spec.Policy, csr); err != nil {
+		return nil, nil, err
+	}
+	facts, err := parseTrustedFacts(csr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkTrustedFacts(spec.TrustedFacts, facts); err != nil {
+		return nil, nil, err
 	}
-	log := p.Log.WithValues("puppetcaissuer csr", subject, "url", p.url)
 
-	log.Info("Creating new Puppet CA client")
-	client, err := puppetca.NewClient(p.url, p.key, p.cert, p.caCert)
+	certname, err := deriveCertname(spec.CertnameTemplate, csrCertnameData(cr, csr))
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to initialize Puppet CA client: %v", err)
+		return nil, nil, err
+	}
+	client, creds := p.getClient()
+	log := p.Log.WithValues("puppetcaissuer csr", certname, "url", client.ActiveEndpoint())
+
+	// Check for a request or certificate already known for this certname
+	submitted := false
+	status, err := p.getStatus(ctx, client, certname)
+	if err != nil && !IsNotFound(err) {
+		return nil, nil, fmt.Errorf("Failed to retrieve certificate status from Puppet CA: %w", err)
+	}
+	if submittedAt, ok := cr.Annotations[api.SubmittedAtAnnotationKey]; ok && IsNotFound(err) {
+		// A Puppet administrator rejected the request, which must not be
+		// submitted again
+		return nil, nil, &RejectedError{Certname: certname, SubmittedAt: submittedAt}
+	}
+	if err == nil {
+		switch status.State {
+		case "requested":
+			// Resume a previous attempt, provided that the pending request is
+			// ours
+			if err := p.checkPendingRequest(ctx, client, certname, csr); err != nil {
+				return nil, nil, err
+			}
+			submitted = true
+
+		case "signed", "revoked":
+			existing, err := p.getCertificate(ctx, client, certname)
+			if err != nil {
+				return nil, nil, err
+			}
+			if status.State == "signed" && bytes.Equal(existing.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+				// Already signed for this request, e.g. manually
+				log.Info("Certificate already signed on Puppet CA")
+				return p.withCABundle(ctx, log, client, creds, existing.Raw)
+			}
+			if err := p.replace(ctx, log, client, certname, status.State, existing, spec, owner); err != nil {
+				return nil, nil, err
+			}
+
+		default:
+			return nil, nil, fmt.Errorf("Unexpected state %q of %s on the Puppet CA", status.State, certname)
+		}
 	}
 
 	// Upload CSR
-	log.Info("Submitting CSR to Puppet CA")
-	err = client.SubmitRequest(subject, string(cr.Spec.Request))
-	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to submit CSR to Puppet CA: %v", err)
+	if !submitted {
+		log.Info("Submitting CSR to Puppet CA")
+		start := time.Now()
+		err := client.SubmitRequest(ctx, certname, string(cr.Spec.Request))
+		p.observe(metrics.OperationSubmit, start)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to submit CSR to Puppet CA: %w", err)
+		}
+	}
+
+	if spec.SigningMode == api.SigningModeManual {
+		log.Info("Waiting for CSR to be signed on Puppet CA")
+		return nil, nil, &PendingError{Certname: certname}
 	}
 
 	// Sign cert
 	log.Info("Signing CSR on Puppet CA")
-	err = client.SignRequest(subject)
+	start := time.Now()
+	err = client.SignRequest(ctx, certname)
+	p.observe(metrics.OperationSign, start)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to sign CSR on Puppet CA: %v", err)
+		return nil, nil, fmt.Errorf("Failed to sign CSR on Puppet CA: %w", err)
 	}
 
 	// Download signed cert
 	log.Info("Getting cert from Puppet CA")
-	certPem, err := client.GetCertByName(subject)
+	cert, err := p.getCertificate(ctx, client, certname)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return p.withCABundle(ctx, log, client, creds, cert.Raw)
+}
+
+// replace revokes and cleans the existing certificate of certname so that a
+// new request can be submitted for it.
+func (p *PuppetCAProvisioner) replace(ctx context.Context, log logr.Logger, client *Client, certname, state string,
+	existing *x509.Certificate, spec *api.PuppetCAIssuerSpec, owner OwnerFunc) error {
+
+	if spec.RenewalPolicy == api.RenewalPolicyFail {
+		return fmt.Errorf("A certificate already exists for %s on the Puppet CA and the issuer renewal policy forbids replacing it", certname)
+	}
+
+	owned, err := owner(certname, existing)
+	if err != nil {
+		return fmt.Errorf("Failed to check the ownership of the existing certificate %s: %w", certname, err)
+	}
+	if !owned {
+		return fmt.Errorf("A certificate already exists for %s on the Puppet CA and was not issued for this Certificate", certname)
+	}
+
+	if state == "signed" {
+		log.Info("Revoking existing certificate on Puppet CA", "serial", existing.SerialNumber.String())
+		start := time.Now()
+		err := client.RevokeCert(ctx, certname)
+		p.observe(metrics.OperationRevoke, start)
+		if err != nil {
+			return fmt.Errorf("Failed to revoke existing certificate on Puppet CA: %w", err)
+		}
+	}
+
+	log.Info("Cleaning existing certificate from Puppet CA", "serial", existing.SerialNumber.String())
+	start := time.Now()
+	err = client.DeleteCertByName(ctx, certname)
+	p.observe(metrics.OperationDelete, start)
+	if err != nil {
+		return fmt.Errorf("Failed to clean existing certificate from Puppet CA: %w", err)
+	}
+	return nil
+}
+
+// withCABundle downloads the CA bundle and returns the certificate chain and
+// the CA bundle expected by Sign.
+func (p *PuppetCAProvisioner) withCABundle(ctx context.Context, log logr.Logger, client *Client, creds Credentials, cert []byte) ([]byte, []byte, error) {
+	log.Info("Getting CA bundle from Puppet CA")
+	start := time.Now()
+	caPem, err := client.GetCertByName(ctx, "ca")
+	p.observe(metrics.OperationFetch, start)
+	if err != nil {
+		log.Error(err, "failed to retrieve CA bundle from Puppet CA, using the issuer CA certificate instead")
+		caPem = creds.CACert
+	}
+
+	intermediates, ca, err := splitCABundle([]byte(caPem))
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error retrieving certificate")
+		return nil, nil, fmt.Errorf("Failed to parse Puppet CA bundle: %v", err)
 	}
 
-	return []byte(certPem), nil, nil
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	return append(certPem, intermediates...), ca, nil
 }
 
-// Cleans the certificate from the Puppet CA
-func (p *PuppetCAProvisioner) Clean(ctx context.Context, crt *certmanager.Certificate) error {
-	subject := crt.Spec.CommonName
-	if subject == "" {
-		return fmt.Errorf("No common name specified")
+// checkPendingRequest returns an error if the request pending for certname on
+// the Puppet CA was not generated from the same key as csr.
+func (p *PuppetCAProvisioner) checkPendingRequest(ctx context.Context, client *Client, certname string, csr *x509.CertificateRequest) error {
+	start := time.Now()
+	pending, err := client.GetRequestByName(ctx, certname)
+	p.observe(metrics.OperationFetch, start)
+	if err != nil {
+		return fmt.Errorf("Failed to retrieve CSR from Puppet CA: %w", err)
+	}
+	pendingCSR, err := decodeCSR([]byte(pending))
+	if err != nil {
+		return fmt.Errorf("Failed to decode CSR from Puppet CA: %v", err)
 	}
-	log := p.Log.WithValues("puppetcaissuer clean cert", subject, "url", p.url)
+	if !bytes.Equal(pendingCSR.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("Another certificate request is pending for %s on the Puppet CA", certname)
+	}
+	return nil
+}
+
+// getStatus returns the status of certname.
+func (p *PuppetCAProvisioner) getStatus(ctx context.Context, client *Client, certname string) (*CertificateStatus, error) {
+	defer p.observe(metrics.OperationStatus, time.Now())
+	return client.GetCertificateStatus(ctx, certname)
+}
 
-	log.Info("Creating new Puppet CA client")
-	client, err := puppetca.NewClient(p.url, p.key, p.cert, p.caCert)
+// getCertificate downloads and decodes the certificate of certname.
+func (p *PuppetCAProvisioner) getCertificate(ctx context.Context, client *Client, certname string) (*x509.Certificate, error) {
+	start := time.Now()
+	certPem, err := client.GetCertByName(ctx, certname)
+	p.observe(metrics.OperationFetch, start)
 	if err != nil {
-		return fmt.Errorf("Failed to initialize Puppet CA client: %v", err)
+		return nil, fmt.Errorf("Error retrieving certificate: %w", err)
+	}
+	return decodeCertificate([]byte(certPem))
+}
+
+// Clean revokes the certificate of certname on the Puppet CA, so that it is
+// added to the CRL, and then removes it from the Puppet CA. A *NotOwnedError
+// is returned if owner does not confirm that the certificate was issued for
+// the Certificate being deleted.
+func (p *PuppetCAProvisioner) Clean(ctx context.Context, certname string, owner OwnerFunc) error {
+	client, _ := p.getClient()
+	log := p.Log.WithValues("puppetcaissuer clean cert", certname, "url", client.ActiveEndpoint())
+
+	found, err := p.revoke(ctx, log, client, certname, owner)
+	if err != nil || !found {
+		return err
 	}
 
 	// Clean Certificate
 	log.Info("Cleaning certificate from Puppet CA")
-	if err = client.DeleteCertByName(subject); err != nil {
-		return fmt.Errorf("Failed to clean certificate from Puppet CA: %v", err)
+	start := time.Now()
+	err = client.DeleteCertByName(ctx, certname)
+	p.observe(metrics.OperationDelete, start)
+	if err != nil {
+		return fmt.Errorf("Failed to clean certificate from Puppet CA: %w", err)
 	}
 
 	return nil
 }
 
+// Revoke revokes the certificate of certname on the Puppet CA, so that it is
+// added to the CRL, but keeps it on the Puppet CA. Like Clean, it only touches
+// certificates owner confirms were issued for the Certificate being deleted.
+func (p *PuppetCAProvisioner) Revoke(ctx context.Context, certname string, owner OwnerFunc) error {
+	client, _ := p.getClient()
+	log := p.Log.WithValues("puppetcaissuer revoke cert", certname, "url", client.ActiveEndpoint())
+
+	_, err := p.revoke(ctx, log, client, certname, owner)
+	return err
+}
+
+// revoke revokes the certificate of certname if it is signed and owned. It
+// returns false if the Puppet CA does not know certname at all.
+func (p *PuppetCAProvisioner) revoke(ctx context.Context, log logr.Logger, client *Client, certname string, owner OwnerFunc) (bool, error) {
+	status, err := p.getStatus(ctx, client, certname)
+	if IsNotFound(err) {
+		log.Info("Certificate not found on Puppet CA, nothing to do")
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Failed to retrieve certificate status from Puppet CA: %w", err)
+	}
+
+	var existing *x509.Certificate
+	if status.State == "signed" || status.State == "revoked" {
+		if existing, err = p.getCertificate(ctx, client, certname); err != nil {
+			return true, err
+		}
+	}
+	owned, err := owner(certname, existing)
+	if err != nil {
+		return true, fmt.Errorf("Failed to check the ownership of certificate %s: %w", certname, err)
+	}
+	if !owned {
+		return true, &NotOwnedError{Certname: certname}
+	}
+
+	if status.State != "signed" {
+		return true, nil
+	}
+
+	log.Info("Revoking certificate on Puppet CA")
+	start := time.Now()
+	err = client.RevokeCert(ctx, certname)
+	p.observe(metrics.OperationRevoke, start)
+	if err != nil {
+		return true, fmt.Errorf("Failed to revoke certificate on Puppet CA: %w", err)
+	}
+	return true, nil
+}
+
 // decodeCSR decodes a certificate request in PEM format and returns the
 func decodeCSR(data []byte) (*x509.CertificateRequest, error) {
 	block, rest := pem.Decode(data)
@@ -155,18 +559,53 @@ func decodeCSR(data []byte) (*x509.CertificateRequest, error) {
 	return csr, nil
 }
 
-// generateSubject returns the first SAN that is not 127.0.0.1 or localhost. The
-// CSRs generated by the Certificate resource have always those SANs. If no SANs
-// are available `awspca-issuer-certificate` will be used as a subject is always
-// required.
-func generateSubject(sans []string) string {
-	if len(sans) == 0 {
-		return "awspca-issuer-certificate"
+// decodeCertificate decodes a certificate in PEM format.
+func decodeCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("PEM is not a certificate")
 	}
-	for _, s := range sans {
-		if s != "127.0.0.1" && s != "localhost" {
-			return s
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// splitCABundle parses a PEM encoded Puppet CA bundle and returns the
+// intermediate CA certificates, to be appended to the signed certificate, and
+// the whole bundle, to be used as the trusted CA. Puppet 6 and later serve the
+// intermediate CA followed by the root CA, earlier versions a single
+// self-signed CA.
+func splitCABundle(data []byte) (intermediates []byte, bundle []byte, err error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
 		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing CA certificate: %v", err)
+		}
+
+		encoded := pem.EncodeToMemory(block)
+		if !isSelfSigned(cert) {
+			intermediates = append(intermediates, encoded...)
+		}
+		bundle = append(bundle, encoded...)
 	}
-	return sans[0]
+
+	if len(bundle) == 0 {
+		return nil, nil, fmt.Errorf("no CA certificate found")
+	}
+	return intermediates, bundle, nil
+}
+
+// isSelfSigned returns true if cert is a root certificate.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
 }
@@ -0,0 +1,707 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// newTestCA returns a CA certificate and its key, signed by parent, or
+// self-signed if parent is nil.
+func newTestCA(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// encodeCertificates returns the PEM encoding of certs.
+func encodeCertificates(certs ...*x509.Certificate) []byte {
+	var data []byte
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return data
+}
+
+// newTestCSR returns a PEM encoded CSR for cn, generated from a new key.
+func newTestCSR(t *testing.T, cn string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+// fakePuppetCA is an in-memory Puppet CA serving the certificate_status,
+// certificate_request and certificate endpoints over TLS.
+type fakePuppetCA struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	signer    *x509.Certificate
+	signerKey *ecdsa.PrivateKey
+	serial    int64
+
+	// bundle is served as the certificate of ca, which is not found when
+	// bundle is empty.
+	bundle string
+
+	// failFetch makes the certificate endpoint fail for every certname but
+	// ca.
+	failFetch bool
+
+	states   map[string]string
+	requests map[string]string
+	certs    map[string]*x509.Certificate
+
+	// changes lists the calls modifying the Puppet CA, e.g.
+	// "PUT certificate_request".
+	changes []string
+}
+
+// newFakePuppetCA returns a started fakePuppetCA signing with a new root CA,
+// which is also its CA bundle.
+func newFakePuppetCA(t *testing.T) *fakePuppetCA {
+	signer, signerKey := newTestCA(t, "Puppet CA", nil, nil)
+	f := &fakePuppetCA{
+		signer:    signer,
+		signerKey: signerKey,
+		bundle:    string(encodeCertificates(signer)),
+		states:    map[string]string{},
+		requests:  map[string]string{},
+		certs:     map[string]*x509.Certificate{},
+	}
+	f.Server = httptest.NewTLSServer(f)
+	return f
+}
+
+// add records a request of csr for certname in the given state, signing it
+// unless the state is requested.
+func (f *fakePuppetCA) add(t *testing.T, certname string, csr []byte, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[certname] = string(csr)
+	f.states[certname] = state
+	if state != "requested" {
+		cert, err := f.sign(csr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.certs[certname] = cert
+	}
+}
+
+// sign issues a certificate for csr.
+func (f *fakePuppetCA) sign(csrPEM []byte) (*x509.Certificate, error) {
+	csr, err := decodeCSR(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+	f.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(f.serial),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, f.signer, csr.PublicKey, f.signerKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (f *fakePuppetCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("X-Puppet-Version", "7.4.0")
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/puppet-ca/v1/"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	endpoint, certname := parts[0], parts[1]
+	if r.Method != http.MethodGet {
+		f.changes = append(f.changes, r.Method+" "+endpoint)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, known := f.states[certname]
+	switch r.Method + " " + endpoint {
+	case "GET certificate_status":
+		if !known {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(CertificateStatus{Name: certname, State: state})
+
+	case "PUT certificate_status":
+		var action struct {
+			DesiredState string `json:"desired_state"`
+		}
+		if err := json.Unmarshal(body, &action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case action.DesiredState == "signed" && state == "requested":
+			cert, err := f.sign([]byte(f.requests[certname]))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			f.certs[certname] = cert
+		case action.DesiredState == "revoked" && state == "signed":
+		default:
+			http.Error(w, "invalid state transition", http.StatusConflict)
+			return
+		}
+		f.states[certname] = action.DesiredState
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE certificate_status":
+		if !known {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.states, certname)
+		delete(f.requests, certname)
+		delete(f.certs, certname)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "PUT certificate_request":
+		if known {
+			http.Error(w, "certname already exists", http.StatusBadRequest)
+			return
+		}
+		f.requests[certname] = string(body)
+		f.states[certname] = "requested"
+
+	case "GET certificate_request":
+		if state != "requested" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(f.requests[certname]))
+
+	case "GET certificate":
+		switch {
+		case certname == "ca" && f.bundle != "":
+			_, _ = w.Write([]byte(f.bundle))
+		case certname == "ca":
+			http.NotFound(w, r)
+		case f.failFetch:
+			http.Error(w, "fetch failed", http.StatusInternalServerError)
+		case f.certs[certname] != nil:
+			_, _ = w.Write(encodeCertificates(f.certs[certname]))
+		default:
+			http.NotFound(w, r)
+		}
+
+	default:
+		http.Error(w, "unexpected call", http.StatusMethodNotAllowed)
+	}
+}
+
+// newTestProvisioner returns a provisioner of the Puppet CA f.
+func newTestProvisioner(t *testing.T, f *fakePuppetCA) *PuppetCAProvisioner {
+	key := Key{Kind: api.PuppetCAIssuerKind, NamespacedName: types.NamespacedName{Namespace: "default", Name: "puppetca"}}
+	p, err := NewProvisioner(key, newTestCredentials(t, f.Certificate(), f.URL), TransportOptions{RequestTimeout: 5 * time.Second}, log.NullLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func owned(string, *x509.Certificate) (bool, error) {
+	return true, nil
+}
+
+func notOwned(string, *x509.Certificate) (bool, error) {
+	return false, nil
+}
+
+func ownerError(string, *x509.Certificate) (bool, error) {
+	return false, errors.New("ledger unavailable")
+}
+
+func TestSign(t *testing.T) {
+	const certname = "web.example.com"
+
+	tests := []struct {
+		name string
+		spec api.PuppetCAIssuerSpec
+
+		// existing is the state of certname before Sign, empty if the
+		// Puppet CA does not know it. otherKey makes it a request of
+		// another key.
+		existing  string
+		otherKey  bool
+		owner     OwnerFunc
+		failFetch bool
+
+		wantErr     bool
+		wantPending bool
+		wantChanges []string
+	}{
+		{
+			name:        "new certname",
+			wantChanges: []string{"PUT certificate_request", "PUT certificate_status"},
+		},
+		{
+			name:        "manual signing",
+			spec:        api.PuppetCAIssuerSpec{SigningMode: api.SigningModeManual},
+			wantPending: true,
+			wantChanges: []string{"PUT certificate_request"},
+		},
+		{
+			name:        "requested",
+			existing:    "requested",
+			wantChanges: []string{"PUT certificate_status"},
+		},
+		{
+			name:        "requested, manual signing",
+			spec:        api.PuppetCAIssuerSpec{SigningMode: api.SigningModeManual},
+			existing:    "requested",
+			wantPending: true,
+		},
+		{
+			name:     "requested with another key",
+			existing: "requested",
+			otherKey: true,
+			wantErr:  true,
+		},
+		{
+			name:     "signed",
+			existing: "signed",
+		},
+		{
+			name:     "signed, manual signing",
+			spec:     api.PuppetCAIssuerSpec{SigningMode: api.SigningModeManual},
+			existing: "signed",
+		},
+		{
+			name:        "signed with another key and owned",
+			existing:    "signed",
+			otherKey:    true,
+			owner:       owned,
+			wantChanges: []string{"PUT certificate_status", "DELETE certificate_status", "PUT certificate_request", "PUT certificate_status"},
+		},
+		{
+			name:     "signed with another key and not owned",
+			existing: "signed",
+			otherKey: true,
+			owner:    notOwned,
+			wantErr:  true,
+		},
+		{
+			name:     "signed with another key and ownership error",
+			existing: "signed",
+			otherKey: true,
+			owner:    ownerError,
+			wantErr:  true,
+		},
+		{
+			name:     "signed with another key and Fail renewal policy",
+			spec:     api.PuppetCAIssuerSpec{RenewalPolicy: api.RenewalPolicyFail},
+			existing: "signed",
+			otherKey: true,
+			owner:    owned,
+			wantErr:  true,
+		},
+		{
+			name:        "revoked and owned",
+			existing:    "revoked",
+			owner:       owned,
+			wantChanges: []string{"DELETE certificate_status", "PUT certificate_request", "PUT certificate_status"},
+		},
+		{
+			name:     "revoked and not owned",
+			existing: "revoked",
+			owner:    notOwned,
+			wantErr:  true,
+		},
+		{
+			name:     "revoked and Fail renewal policy",
+			spec:     api.PuppetCAIssuerSpec{RenewalPolicy: api.RenewalPolicyFail},
+			existing: "revoked",
+			owner:    owned,
+			wantErr:  true,
+		},
+		{
+			name:        "fetch fails after signing",
+			failFetch:   true,
+			wantErr:     true,
+			wantChanges: []string{"PUT certificate_request", "PUT certificate_status"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakePuppetCA(t)
+			defer f.Close()
+			f.failFetch = tt.failFetch
+			p := newTestProvisioner(t, f)
+
+			csr := newTestCSR(t, certname)
+			if tt.existing != "" {
+				existing := csr
+				if tt.otherKey {
+					existing = newTestCSR(t, certname)
+				}
+				f.add(t, certname, existing, tt.existing)
+			}
+			owner := tt.owner
+			if owner == nil {
+				owner = notOwned
+			}
+
+			cr := &certmanager.CertificateRequest{
+				ObjectMeta: meta.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec:       certmanager.CertificateRequestSpec{Request: csr},
+			}
+			chain, ca, err := p.Sign(context.Background(), cr, &tt.spec, owner)
+			if IsPending(err) != tt.wantPending {
+				t.Fatalf("Sign() error = %v, wantPending %v", err, tt.wantPending)
+			}
+			if (err != nil && !tt.wantPending) != tt.wantErr {
+				t.Fatalf("Sign() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(f.changes, tt.wantChanges) {
+				t.Errorf("Sign() changed the Puppet CA with %v, want %v", f.changes, tt.wantChanges)
+			}
+			if err != nil {
+				return
+			}
+
+			cert, err := decodeCertificate(chain)
+			if err != nil {
+				t.Fatalf("Sign() returned an invalid chain: %v", err)
+			}
+			request, _ := decodeCSR(csr)
+			if !bytes.Equal(cert.RawSubjectPublicKeyInfo, request.RawSubjectPublicKeyInfo) {
+				t.Errorf("Sign() returned a certificate of another key")
+			}
+			if string(ca) != f.bundle {
+				t.Errorf("Sign() CA = %s, want %s", ca, f.bundle)
+			}
+		})
+	}
+}
+
+func TestSignRejected(t *testing.T) {
+	f := newFakePuppetCA(t)
+	defer f.Close()
+	p := newTestProvisioner(t, f)
+	cr := &certmanager.CertificateRequest{
+		ObjectMeta: meta.ObjectMeta{
+			Namespace:   "default",
+			Name:        "web",
+			Annotations: map[string]string{api.SubmittedAtAnnotationKey: "2021-01-01T00:00:00Z"},
+		},
+		Spec: certmanager.CertificateRequestSpec{Request: newTestCSR(t, "web.example.com")},
+	}
+	spec := &api.PuppetCAIssuerSpec{SigningMode: api.SigningModeManual}
+
+	if _, _, err := p.Sign(context.Background(), cr, spec, notOwned); !IsRejected(err) {
+		t.Errorf("Sign() error = %v, want a *RejectedError", err)
+	}
+	if len(f.changes) != 0 {
+		t.Errorf("Sign() changed the Puppet CA with %v, want no change", f.changes)
+	}
+}
+
+func TestSplitCABundle(t *testing.T) {
+	root, rootKey := newTestCA(t, "Root CA", nil, nil)
+	intermediate, intermediateKey := newTestCA(t, "Intermediate CA", root, rootKey)
+	issuing, _ := newTestCA(t, "Issuing CA", intermediate, intermediateKey)
+	crl := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: []byte("crl")})
+
+	tests := []struct {
+		name              string
+		data              []byte
+		wantIntermediates []byte
+		wantBundle        []byte
+		wantErr           bool
+	}{
+		{
+			name:       "root only",
+			data:       encodeCertificates(root),
+			wantBundle: encodeCertificates(root),
+		},
+		{
+			name:              "intermediate and root",
+			data:              encodeCertificates(intermediate, root),
+			wantIntermediates: encodeCertificates(intermediate),
+			wantBundle:        encodeCertificates(intermediate, root),
+		},
+		{
+			name:              "leaf first",
+			data:              encodeCertificates(issuing, intermediate, root),
+			wantIntermediates: encodeCertificates(issuing, intermediate),
+			wantBundle:        encodeCertificates(issuing, intermediate, root),
+		},
+		{
+			name:              "unordered",
+			data:              encodeCertificates(root, issuing, intermediate),
+			wantIntermediates: encodeCertificates(issuing, intermediate),
+			wantBundle:        encodeCertificates(root, issuing, intermediate),
+		},
+		{
+			name:              "no self-signed certificate",
+			data:              encodeCertificates(intermediate),
+			wantIntermediates: encodeCertificates(intermediate),
+			wantBundle:        encodeCertificates(intermediate),
+		},
+		{
+			name:       "other PEM blocks",
+			data:       append(crl, encodeCertificates(root)...),
+			wantBundle: encodeCertificates(root),
+		},
+		{
+			name:    "garbage",
+			data:    []byte("not a PEM bundle"),
+			wantErr: true,
+		},
+		{
+			name:    "invalid certificate",
+			data:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			intermediates, bundle, err := splitCABundle(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitCABundle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(intermediates, tt.wantIntermediates) {
+				t.Errorf("splitCABundle() intermediates = %s, want %s", intermediates, tt.wantIntermediates)
+			}
+			if !bytes.Equal(bundle, tt.wantBundle) {
+				t.Errorf("splitCABundle() bundle = %s, want %s", bundle, tt.wantBundle)
+			}
+		})
+	}
+}
+
+func TestWithCABundle(t *testing.T) {
+	root, rootKey := newTestCA(t, "Root CA", nil, nil)
+	intermediate, _ := newTestCA(t, "Intermediate CA", root, rootKey)
+	leaf := []byte("leaf")
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+
+	tests := []struct {
+		name      string
+		bundle    string
+		wantChain []byte
+		wantCA    func(creds Credentials) string
+		wantErr   bool
+	}{
+		{
+			name:      "served bundle",
+			bundle:    string(encodeCertificates(intermediate, root)),
+			wantChain: append(append([]byte{}, leafPEM...), encodeCertificates(intermediate)...),
+			wantCA: func(Credentials) string {
+				return string(encodeCertificates(intermediate, root))
+			},
+		},
+		{
+			name:      "bundle fetch fails",
+			wantChain: leafPEM,
+			wantCA: func(creds Credentials) string {
+				return creds.CACert
+			},
+		},
+		{
+			name:    "invalid bundle",
+			bundle:  "not a PEM bundle",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakePuppetCA(t)
+			defer f.Close()
+			f.bundle = tt.bundle
+			p := newTestProvisioner(t, f)
+			client, creds := p.getClient()
+
+			chain, ca, err := p.withCABundle(context.Background(), p.Log, client, creds, leaf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("withCABundle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(chain, tt.wantChain) {
+				t.Errorf("withCABundle() chain = %s, want %s", chain, tt.wantChain)
+			}
+			if want := tt.wantCA(creds); string(ca) != want {
+				t.Errorf("withCABundle() CA = %s, want %s", ca, want)
+			}
+		})
+	}
+}
+
+func TestCleanAndRevoke(t *testing.T) {
+	const certname = "web.example.com"
+
+	tests := []struct {
+		name         string
+		revokeOnly   bool
+		existing     string
+		owner        OwnerFunc
+		wantErr      bool
+		wantNotOwned bool
+		wantChanges  []string
+	}{
+		{
+			name:        "clean owned",
+			existing:    "signed",
+			owner:       owned,
+			wantChanges: []string{"PUT certificate_status", "DELETE certificate_status"},
+		},
+		{
+			name:        "clean owned revoked certificate",
+			existing:    "revoked",
+			owner:       owned,
+			wantChanges: []string{"DELETE certificate_status"},
+		},
+		{
+			name:         "clean not owned",
+			existing:     "signed",
+			owner:        notOwned,
+			wantErr:      true,
+			wantNotOwned: true,
+		},
+		{
+			name:     "clean ownership error",
+			existing: "signed",
+			owner:    ownerError,
+			wantErr:  true,
+		},
+		{
+			name:  "clean unknown certname",
+			owner: owned,
+		},
+		{
+			name:        "revoke owned",
+			revokeOnly:  true,
+			existing:    "signed",
+			owner:       owned,
+			wantChanges: []string{"PUT certificate_status"},
+		},
+		{
+			name:         "revoke not owned",
+			revokeOnly:   true,
+			existing:     "signed",
+			owner:        notOwned,
+			wantErr:      true,
+			wantNotOwned: true,
+		},
+		{
+			name:       "revoke ownership error",
+			revokeOnly: true,
+			existing:   "signed",
+			owner:      ownerError,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakePuppetCA(t)
+			defer f.Close()
+			p := newTestProvisioner(t, f)
+			if tt.existing != "" {
+				f.add(t, certname, newTestCSR(t, certname), tt.existing)
+			}
+
+			var err error
+			if tt.revokeOnly {
+				err = p.Revoke(context.Background(), certname, tt.owner)
+			} else {
+				err = p.Clean(context.Background(), certname, tt.owner)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if IsNotOwned(err) != tt.wantNotOwned {
+				t.Errorf("IsNotOwned(%v) = %v, want %v", err, IsNotOwned(err), tt.wantNotOwned)
+			}
+			if !reflect.DeepEqual(f.changes, tt.wantChanges) {
+				t.Errorf("changed the Puppet CA with %v, want %v", f.changes, tt.wantChanges)
+			}
+		})
+	}
+}
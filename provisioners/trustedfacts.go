@@ -0,0 +1,235 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"sort"
+	"strings"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+var (
+	// ppRegCertExt is the arc of the registered Puppet extensions, such as
+	// pp_role, which become trusted facts.
+	ppRegCertExt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 34380, 1, 1}
+
+	// ppPrivCertExt is the arc of the private Puppet extensions.
+	ppPrivCertExt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 34380, 1, 2}
+
+	// ppAuthCertExt is the arc of the Puppet authorization extensions, such
+	// as pp_auth_role, which Puppet Server uses to authorize requests.
+	ppAuthCertExt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 34380, 1, 3}
+)
+
+// trustedFactNames maps the OIDs of the Puppet extensions to their short
+// names, as documented in Puppet's CSR attributes reference.
+var trustedFactNames = map[string]string{
+	"1.3.6.1.4.1.34380.1.1.1":  "pp_uuid",
+	"1.3.6.1.4.1.34380.1.1.2":  "pp_instance_id",
+	"1.3.6.1.4.1.34380.1.1.3":  "pp_image_name",
+	"1.3.6.1.4.1.34380.1.1.4":  "pp_preshared_key",
+	"1.3.6.1.4.1.34380.1.1.5":  "pp_cost_center",
+	"1.3.6.1.4.1.34380.1.1.6":  "pp_product",
+	"1.3.6.1.4.1.34380.1.1.7":  "pp_project",
+	"1.3.6.1.4.1.34380.1.1.8":  "pp_application",
+	"1.3.6.1.4.1.34380.1.1.9":  "pp_service",
+	"1.3.6.1.4.1.34380.1.1.10": "pp_employee",
+	"1.3.6.1.4.1.34380.1.1.11": "pp_created_by",
+	"1.3.6.1.4.1.34380.1.1.12": "pp_environment",
+	"1.3.6.1.4.1.34380.1.1.13": "pp_role",
+	"1.3.6.1.4.1.34380.1.1.14": "pp_software_version",
+	"1.3.6.1.4.1.34380.1.1.15": "pp_department",
+	"1.3.6.1.4.1.34380.1.1.16": "pp_cluster",
+	"1.3.6.1.4.1.34380.1.1.17": "pp_provisioner",
+	"1.3.6.1.4.1.34380.1.1.18": "pp_region",
+	"1.3.6.1.4.1.34380.1.1.19": "pp_datacenter",
+	"1.3.6.1.4.1.34380.1.1.20": "pp_zone",
+	"1.3.6.1.4.1.34380.1.1.21": "pp_network",
+	"1.3.6.1.4.1.34380.1.1.22": "pp_securitypolicy",
+	"1.3.6.1.4.1.34380.1.1.23": "pp_cloudplatform",
+	"1.3.6.1.4.1.34380.1.1.24": "pp_apptier",
+	"1.3.6.1.4.1.34380.1.1.25": "pp_hostname",
+	"1.3.6.1.4.1.34380.1.1.26": "pp_owner",
+	"1.3.6.1.4.1.34380.1.3.1":  "pp_authorization",
+	"1.3.6.1.4.1.34380.1.3.13": "pp_auth_role",
+	"1.3.6.1.4.1.34380.1.3.39": "pp_cli_auth",
+}
+
+// TrustedFact is a Puppet extension requested in a CSR.
+type TrustedFact struct {
+	// Name is the short name of the extension, e.g. pp_role, or its OID if
+	// it has none, as is the case for private extensions.
+	Name string
+
+	OID   asn1.ObjectIdentifier
+	Value string
+
+	// Authorization is true for the pp_auth_* extensions.
+	Authorization bool
+}
+
+// TrustedFacts returns the Puppet extensions requested in the PEM encoded
+// CSR, sorted by name.
+func TrustedFacts(csrPEM []byte) ([]TrustedFact, error) {
+	csr, err := decodeCSR(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+	return parseTrustedFacts(csr)
+}
+
+func parseTrustedFacts(csr *x509.CertificateRequest) ([]TrustedFact, error) {
+	var facts []TrustedFact
+	for _, ext := range csr.Extensions {
+		if !inArc(ext.Id, ppRegCertExt) && !inArc(ext.Id, ppPrivCertExt) && !inArc(ext.Id, ppAuthCertExt) {
+			continue
+		}
+
+		// Puppet encodes the values as UTF8String, but accepts any string
+		var raw asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &raw); err != nil {
+			return nil, fmt.Errorf("error parsing extension %s: %v", ext.Id, err)
+		}
+
+		name, ok := trustedFactNames[ext.Id.String()]
+		if !ok {
+			name = ext.Id.String()
+		}
+		facts = append(facts, TrustedFact{
+			Name:          name,
+			OID:           ext.Id,
+			Value:         string(raw.Bytes),
+			Authorization: inArc(ext.Id, ppAuthCertExt),
+		})
+	}
+
+	sort.Slice(facts, func(i, j int) bool { return facts[i].Name < facts[j].Name })
+	return facts, nil
+}
+
+// ValidateTrustedFactsPolicy returns an error if policy refers to an
+// extension that is neither a known Puppet extension name nor an OID under
+// the Puppet arcs.
+func ValidateTrustedFactsPolicy(policy *api.TrustedFactsPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	names := append([]string{}, policy.Allowed...)
+	for name := range policy.Required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !isTrustedFactName(name) {
+			return fmt.Errorf("unknown Puppet extension %q", name)
+		}
+	}
+	return nil
+}
+
+// checkTrustedFacts returns a *PolicyError for the first fact violating
+// policy. Without a policy, the pp_auth_* authorization extensions are
+// denied and every other extension is allowed.
+func checkTrustedFacts(policy *api.TrustedFactsPolicy, facts []TrustedFact) error {
+	for _, fact := range facts {
+		allowed := !fact.Authorization
+		if policy != nil {
+			if len(policy.Allowed) > 0 {
+				allowed = matchesTrustedFact(policy.Allowed, fact)
+			}
+			if _, ok := requiredValue(policy, fact); ok {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return &PolicyError{Field: "Puppet extension", Name: fact.Name}
+		}
+
+		if value, ok := requiredValue(policy, fact); ok && fact.Value != value {
+			return &PolicyError{Field: "Puppet extension", Name: fact.Name,
+				Detail: fmt.Sprintf("must be %q per the issuer policy, got %q", value, fact.Value)}
+		}
+	}
+
+	if policy == nil {
+		return nil
+	}
+	required := make([]string, 0, len(policy.Required))
+	for name := range policy.Required {
+		required = append(required, name)
+	}
+	sort.Strings(required)
+	for _, name := range required {
+		found := false
+		for _, fact := range facts {
+			if fact.Name == name || fact.OID.String() == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &PolicyError{Field: "Puppet extension", Name: name, Detail: "is required by the issuer policy"}
+		}
+	}
+	return nil
+}
+
+// requiredValue returns the value the policy requires for fact, if any.
+func requiredValue(policy *api.TrustedFactsPolicy, fact TrustedFact) (string, bool) {
+	if policy == nil {
+		return "", false
+	}
+	if value, ok := policy.Required[fact.Name]; ok {
+		return value, true
+	}
+	value, ok := policy.Required[fact.OID.String()]
+	return value, ok
+}
+
+// matchesTrustedFact returns true if names lists the name or OID of fact.
+func matchesTrustedFact(names []string, fact TrustedFact) bool {
+	for _, name := range names {
+		if name == fact.Name || name == fact.OID.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedFactName returns true if name is a known Puppet extension name or
+// an OID under one of the Puppet arcs.
+func isTrustedFactName(name string) bool {
+	for _, known := range trustedFactNames {
+		if name == known {
+			return true
+		}
+	}
+	for _, arc := range []asn1.ObjectIdentifier{ppRegCertExt, ppPrivCertExt, ppAuthCertExt} {
+		if strings.HasPrefix(name, arc.String()+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// inArc returns true if oid is below arc.
+func inArc(oid, arc asn1.ObjectIdentifier) bool {
+	return len(oid) > len(arc) && oid[:len(arc)].Equal(arc)
+}
@@ -0,0 +1,234 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provisioners
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"testing"
+
+	api "github.com/camptocamp/puppetca-issuer/api/v1beta1"
+)
+
+// extension returns a CSR extension holding value as a UTF8String, the way
+// Puppet encodes its extensions.
+func extension(t *testing.T, oid asn1.ObjectIdentifier, value string) pkix.Extension {
+	data, err := asn1.MarshalWithParams(value, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: oid, Value: data}
+}
+
+func oid(arc asn1.ObjectIdentifier, ids ...int) asn1.ObjectIdentifier {
+	return append(append(asn1.ObjectIdentifier{}, arc...), ids...)
+}
+
+func TestParseTrustedFacts(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []pkix.Extension
+		want       []TrustedFact
+		wantErr    bool
+	}{
+		{
+			name: "no Puppet extension",
+			extensions: []pkix.Extension{
+				{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: []byte{0x30, 0x00}},
+			},
+		},
+		{
+			name: "registered, private and authorization extensions",
+			extensions: []pkix.Extension{
+				extension(t, oid(ppRegCertExt, 13), "web"),
+				extension(t, oid(ppPrivCertExt, 7), "private"),
+				extension(t, oid(ppAuthCertExt, 13), "admin"),
+			},
+			want: []TrustedFact{
+				{Name: "1.3.6.1.4.1.34380.1.2.7", OID: oid(ppPrivCertExt, 7), Value: "private"},
+				{Name: "pp_auth_role", OID: oid(ppAuthCertExt, 13), Value: "admin", Authorization: true},
+				{Name: "pp_role", OID: oid(ppRegCertExt, 13), Value: "web"},
+			},
+		},
+		{
+			name: "arc itself is not an extension",
+			extensions: []pkix.Extension{
+				extension(t, ppRegCertExt, "web"),
+			},
+		},
+		{
+			name: "invalid value",
+			extensions: []pkix.Extension{
+				{Id: oid(ppRegCertExt, 13), Value: []byte{0x0c}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTrustedFacts(&x509.CertificateRequest{Extensions: tt.extensions})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTrustedFacts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseTrustedFacts() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Name != tt.want[i].Name || !got[i].OID.Equal(tt.want[i].OID) ||
+					got[i].Value != tt.want[i].Value || got[i].Authorization != tt.want[i].Authorization {
+					t.Errorf("parseTrustedFacts()[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTrustedFacts(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:         pkix.Name{CommonName: "web.example.com"},
+		ExtraExtensions: []pkix.Extension{extension(t, oid(ppRegCertExt, 12), "production")},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	facts, err := TrustedFacts(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	if err != nil {
+		t.Fatalf("TrustedFacts() error = %v", err)
+	}
+	if len(facts) != 1 || facts[0].Name != "pp_environment" || facts[0].Value != "production" {
+		t.Errorf("TrustedFacts() = %+v, want pp_environment=production", facts)
+	}
+}
+
+func TestValidateTrustedFactsPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *api.TrustedFactsPolicy
+		wantErr bool
+	}{
+		{
+			name: "no policy",
+		},
+		{
+			name: "known names and OIDs",
+			policy: &api.TrustedFactsPolicy{
+				Allowed:  []string{"pp_role", "1.3.6.1.4.1.34380.1.2.7"},
+				Required: map[string]string{"pp_environment": "production"},
+			},
+		},
+		{
+			name:    "unknown allowed name",
+			policy:  &api.TrustedFactsPolicy{Allowed: []string{"role"}},
+			wantErr: true,
+		},
+		{
+			name:    "required OID outside the Puppet arcs",
+			policy:  &api.TrustedFactsPolicy{Required: map[string]string{"1.3.6.1.4.1.34380.2.1": "x"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateTrustedFactsPolicy(tt.policy); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTrustedFactsPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckTrustedFacts(t *testing.T) {
+	role := TrustedFact{Name: "pp_role", OID: oid(ppRegCertExt, 13), Value: "web"}
+	private := TrustedFact{Name: "1.3.6.1.4.1.34380.1.2.7", OID: oid(ppPrivCertExt, 7), Value: "private"}
+	authRole := TrustedFact{Name: "pp_auth_role", OID: oid(ppAuthCertExt, 13), Value: "admin", Authorization: true}
+
+	tests := []struct {
+		name     string
+		policy   *api.TrustedFactsPolicy
+		facts    []TrustedFact
+		wantName string
+	}{
+		{
+			name:  "no policy allows non-authorization extensions",
+			facts: []TrustedFact{role, private},
+		},
+		{
+			name:     "no policy denies authorization extensions",
+			facts:    []TrustedFact{role, authRole},
+			wantName: "pp_auth_role",
+		},
+		{
+			name:   "allowed authorization extension",
+			policy: &api.TrustedFactsPolicy{Allowed: []string{"pp_role", "pp_auth_role"}},
+			facts:  []TrustedFact{role, authRole},
+		},
+		{
+			name:     "extension not allowed",
+			policy:   &api.TrustedFactsPolicy{Allowed: []string{"pp_role"}},
+			facts:    []TrustedFact{role, private},
+			wantName: private.Name,
+		},
+		{
+			name:   "allowed by OID",
+			policy: &api.TrustedFactsPolicy{Allowed: []string{"1.3.6.1.4.1.34380.1.2.7"}},
+			facts:  []TrustedFact{private},
+		},
+		{
+			name:   "required value",
+			policy: &api.TrustedFactsPolicy{Allowed: []string{"pp_environment"}, Required: map[string]string{"pp_role": "web"}},
+			facts:  []TrustedFact{role},
+		},
+		{
+			name:     "wrong required value",
+			policy:   &api.TrustedFactsPolicy{Required: map[string]string{"pp_role": "db"}},
+			facts:    []TrustedFact{role},
+			wantName: "pp_role",
+		},
+		{
+			name:     "missing required extension",
+			policy:   &api.TrustedFactsPolicy{Required: map[string]string{"pp_environment": "production"}},
+			facts:    []TrustedFact{role},
+			wantName: "pp_environment",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTrustedFacts(tt.policy, tt.facts)
+			if tt.wantName == "" {
+				if err != nil {
+					t.Errorf("checkTrustedFacts() error = %v, want nil", err)
+				}
+				return
+			}
+			policyErr, ok := err.(*PolicyError)
+			if !ok {
+				t.Fatalf("checkTrustedFacts() error = %v, want *PolicyError", err)
+			}
+			if policyErr.Name != tt.wantName {
+				t.Errorf("checkTrustedFacts() denied %q, want %q", policyErr.Name, tt.wantName)
+			}
+		})
+	}
+}